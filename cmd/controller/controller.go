@@ -2,23 +2,27 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"path"
 	"strings"
 	"time"
 
+	"github.com/metal-stack/csi-lvm/internal/provisionerpod"
+	"github.com/metal-stack/csi-lvm/internal/volume"
 	v1 "k8s.io/api/core/v1"
 	k8serror "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v10/controller"
 
 	"k8s.io/klog/v2"
 )
 
 const (
-	keyNode          = "kubernetes.io/hostname"
+	keyNode          = volume.KeyNode
 	typeAnnotation   = "csi-lvm.metal-stack.io/type"
 	linearType       = "linear"
 	stripedType      = "striped"
@@ -27,6 +31,10 @@ const (
 	actionTypeDelete = "delete"
 	pullAlways       = "always"
 	pullIfNotPresent = "ifnotpresent"
+	// fsckPolicyParameter is the storageclass parameter to check filesystems before they are mounted again: never, preen or always
+	fsckPolicyParameter = "fsckPolicy"
+	// fsLabelParameter is the storageclass parameter to label filesystems with the truncated name of their claim
+	fsLabelParameter = "fsLabel"
 )
 
 type actionType string
@@ -34,8 +42,8 @@ type actionType string
 type lvmProvisioner struct {
 	// The directory to create the directories for every lv and mount them
 	lvDir string
-	// devicePattern specifies a pattern of host devices to be part of the main volume group
-	devicePattern string
+	// deviceSelector specifies which host devices are part of the main volume group
+	deviceSelector deviceSelector
 	// image to execute lvm commands
 	provisionerImage string
 	kubeClient       clientset.Interface
@@ -44,24 +52,39 @@ type lvmProvisioner struct {
 	defaultLVMType string
 	pullPolicy     v1.PullPolicy
 	vgName         string
+	// serviceAccount of the provisioner pod, the namespace default if empty
+	serviceAccount string
+	// keepFailedVolumes keeps the state of a failed createlv on the node instead of rolling it back
+	keepFailedVolumes bool
+	// queue limits the concurrent provisioner pods per node
+	queue *nodeQueue
+	// forgetVolumesOfDeletedNodes deletes persistent volumes of nodes which do not exist anymore without cleanup on the node
+	forgetVolumesOfDeletedNodes bool
+	eventRecorder               record.EventRecorder
 }
 
 // NewLVMProvisioner creates a new lvm provisioner
-func NewLVMProvisioner(kubeClient clientset.Interface, namespace, vgName, lvDir, devicePattern, provisionerImage, defaultLVMType, pullPolicy string) controller.Provisioner {
+func NewLVMProvisioner(kubeClient clientset.Interface, namespace, vgName, lvDir string, deviceSelector deviceSelector, provisionerImage, defaultLVMType, pullPolicy, serviceAccount string, keepFailedVolumes bool, queue *nodeQueue, forgetVolumesOfDeletedNodes bool, eventRecorder record.EventRecorder) controller.Provisioner {
 	pp := v1.PullAlways
 	if strings.ToLower(pullPolicy) == pullIfNotPresent {
 		pp = v1.PullIfNotPresent
 	}
 
 	return &lvmProvisioner{
-		lvDir:            lvDir,
-		devicePattern:    devicePattern,
-		provisionerImage: provisionerImage,
-		kubeClient:       kubeClient,
-		namespace:        namespace,
-		vgName:           vgName,
-		defaultLVMType:   defaultLVMType,
-		pullPolicy:       pp,
+		lvDir:             lvDir,
+		deviceSelector:    deviceSelector,
+		provisionerImage:  provisionerImage,
+		kubeClient:        kubeClient,
+		namespace:         namespace,
+		vgName:            vgName,
+		defaultLVMType:    defaultLVMType,
+		pullPolicy:        pp,
+		serviceAccount:    serviceAccount,
+		keepFailedVolumes: keepFailedVolumes,
+		queue:             queue,
+
+		forgetVolumesOfDeletedNodes: forgetVolumesOfDeletedNodes,
+		eventRecorder:               eventRecorder,
 	}
 }
 
@@ -75,6 +98,12 @@ type volumeAction struct {
 	size     int64
 	lvmType  string
 	isBlock  bool
+	// fsckPolicy is empty for the provisioner default
+	fsckPolicy string
+	// tags describe the volume to rebuild its persistent volume from the logical volume
+	tags []string
+	// fsLabel is the label of the filesystem, none if empty
+	fsLabel string
 }
 
 // SupportsBlock returns whether provisioner supports block volume.
@@ -86,7 +115,7 @@ func (p *lvmProvisioner) SupportsBlock(ctx context.Context) bool {
 
 // Provision creates a storage asset and returns a PV object representing it.
 func (p *lvmProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
-	klog.Infof("start provision %s node:%s devices:%s", options.PVName, options.SelectedNode.GetName(), p.devicePattern)
+	klog.Infof("start provision %s node:%s devices:%s", options.PVName, options.SelectedNode.GetName(), p.deviceSelector.pattern)
 	node := options.SelectedNode
 	if node == nil {
 		return nil, controller.ProvisioningFinished, fmt.Errorf("configuration error, no node was specified")
@@ -118,6 +147,13 @@ func (p *lvmProvisioner) Provision(ctx context.Context, options controller.Provi
 		return nil, controller.ProvisioningFinished, fmt.Errorf("configuration error, no volume size not readable")
 	}
 
+	fsckPolicy := options.StorageClass.Parameters[fsckPolicyParameter]
+	switch fsckPolicy {
+	case "", "never", "preen", "always":
+	default:
+		return nil, controller.ProvisioningFinished, fmt.Errorf("configuration error, %s %s is invalid", fsckPolicyParameter, fsckPolicy)
+	}
+
 	volumeMode := v1.PersistentVolumeFilesystem
 	isBlock := false
 	if options.PVC.Spec.VolumeMode != nil && *options.PVC.Spec.VolumeMode == v1.PersistentVolumeBlock {
@@ -125,104 +161,131 @@ func (p *lvmProvisioner) Provision(ctx context.Context, options controller.Provi
 		volumeMode = v1.PersistentVolumeBlock
 	}
 
+	fsType := "ext4"
+	if isBlock {
+		fsType = ""
+	}
+	var fsLabel string
+	switch options.StorageClass.Parameters[fsLabelParameter] {
+	case "", "false":
+	case "true":
+		if !isBlock {
+			fsLabel = options.PVC.Name
+		}
+	default:
+		return nil, controller.ProvisioningFinished, fmt.Errorf("configuration error, %s %s is invalid", fsLabelParameter, options.StorageClass.Parameters[fsLabelParameter])
+	}
+
+	metadata := volume.Metadata{
+		PVCNamespace:  options.PVC.Namespace,
+		PVCName:       options.PVC.Name,
+		PVCUID:        options.PVC.UID,
+		StorageClass:  options.StorageClass.Name,
+		AccessModes:   options.PVC.Spec.AccessModes,
+		VolumeMode:    volumeMode,
+		ReclaimPolicy: *options.StorageClass.ReclaimPolicy,
+		FSType:        fsType,
+		Capacity:      requests,
+	}
+
 	va := volumeAction{
-		action:   actionTypeCreate,
-		name:     name,
-		path:     path,
-		nodeName: node.Name,
-		size:     size,
-		lvmType:  lvmType,
-		isBlock:  isBlock,
+		action:     actionTypeCreate,
+		name:       name,
+		path:       path,
+		nodeName:   node.Name,
+		size:       size,
+		lvmType:    lvmType,
+		isBlock:    isBlock,
+		fsckPolicy: fsckPolicy,
+		tags:       metadata.Tags(),
+		fsLabel:    fsLabel,
 	}
 	if err := p.createProvisionerPod(ctx, va); err != nil {
-		klog.Errorf("error creating provisioner pod :%v", err)
-		return nil, controller.ProvisioningReschedule, err
-	}
-
-	pv := &v1.PersistentVolume{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: options.PVName,
-			Annotations: map[string]string{
-				"lvmProvisionerIdentity": node.Name,
-			},
-		},
-		Spec: v1.PersistentVolumeSpec{
-			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
-			AccessModes:                   options.PVC.Spec.AccessModes,
-			Capacity: v1.ResourceList{
-				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
-			},
-			PersistentVolumeSource: v1.PersistentVolumeSource{
-				Local: &v1.LocalVolumeSource{
-					Path: path,
-				},
-			},
-			VolumeMode: &volumeMode,
-			NodeAffinity: &v1.VolumeNodeAffinity{
-				Required: &v1.NodeSelector{
-					NodeSelectorTerms: []v1.NodeSelectorTerm{
-						{
-							MatchExpressions: []v1.NodeSelectorRequirement{
-								{
-									Key:      keyNode,
-									Operator: v1.NodeSelectorOpIn,
-									Values: []string{
-										node.Name,
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+		state := provisioningState(err)
+		klog.Errorf("error creating provisioner pod, state:%s err:%v", state, err)
+		return nil, state, err
 	}
 
+	pv := volume.PersistentVolume(options.PVName, path, node.Name, metadata)
+
 	return pv, controller.ProvisioningFinished, nil
 }
 
 // Delete removes the storage asset that was created by Provision represented
 // by the given PV.
-func (p *lvmProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) (err error) {
-	path, node, err := p.getPathAndNodeForPV(volume)
+func (p *lvmProvisioner) Delete(ctx context.Context, pv *v1.PersistentVolume) (err error) {
+	path, node, err := p.getPathAndNodeForPV(pv)
 	if err != nil {
 		return err
 	}
 
 	_, err = p.kubeClient.CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{})
-	if err != nil {
-		if k8serror.IsNotFound(err) {
-			klog.Infof("node %s not found anymore. Assuming volume %s is gone for good.", node, volume.Name)
+	if k8serror.IsNotFound(err) {
+		if p.forgetVolumesOfDeletedNodes {
+			p.eventRecorder.Eventf(pv, v1.EventTypeWarning, "NodeNotFound", "node %s not found, the persistent volume is deleted without cleaning up the logical volume", node)
+			klog.Infof("node %s of volume %s not found, volume is forgotten", node, pv.Name)
 			return nil
 		}
+		// the library does not retry an ignored deletion, the persistent volume stays released until it is deleted manually
+		p.eventRecorder.Eventf(pv, v1.EventTypeWarning, "NodeNotFound", "node %s not found, the logical volume can not be deleted, delete the persistent volume manually if the node is gone for good", node)
+		return &controller.IgnoredError{Reason: fmt.Sprintf("node %s of volume %s not found", node, pv.Name)}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get node %s err:%w", node, err)
 	}
 
-	klog.Infof("delete volume: %s on node:%s reclaim:%s", path, node, volume.Spec.PersistentVolumeReclaimPolicy)
-	if volume.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+	klog.Infof("delete volume: %s on node:%s reclaim:%s", path, node, pv.Spec.PersistentVolumeReclaimPolicy)
+	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
 		isBlock := false
-		if volume.Spec.VolumeMode != nil && *volume.Spec.VolumeMode == v1.PersistentVolumeBlock {
+		if pv.Spec.VolumeMode != nil && *pv.Spec.VolumeMode == v1.PersistentVolumeBlock {
 			isBlock = true
 		}
 
-		klog.Infof("deleting volume %v at %v:%v", volume.Name, node, path)
+		klog.Infof("deleting volume %v at %v:%v", pv.Name, node, path)
 		va := volumeAction{
 			action:   actionTypeDelete,
-			name:     volume.Name,
+			name:     pv.Name,
 			path:     path,
 			nodeName: node,
 			size:     0,
 			isBlock:  isBlock,
 		}
 		if err := p.createProvisionerPod(ctx, va); err != nil {
-			klog.Infof("clean up volume %v failed: %v", volume.Name, err)
+			var podErr *provisionerpod.Error
+			if errors.As(err, &podErr) && podErr.Reason == provisionerpod.ReasonBusy {
+				// the library retries with backoff, the volume is never removed underneath a running container
+				return fmt.Errorf("volume %s is still in use, deletion is retried: %w", pv.Name, err)
+			}
+			klog.Infof("clean up volume %v failed: %v", pv.Name, err)
 			return err
 		}
 		return nil
 	}
-	klog.Infof("Retained volume %v", volume.Name)
+	klog.Infof("Retained volume %v", pv.Name)
 	return nil
 }
 
+// provisioningState decides how the library continues after a failed provisioning:
+// on another node if this one has not enough space, on the same node with backoff if the failure is transient
+// and with a final error if the parameters are invalid or another volume of the same name exists. The library reports the error as event on the claim in any case.
+func provisioningState(err error) controller.ProvisioningState {
+	var podErr *provisionerpod.Error
+	if !errors.As(err, &podErr) {
+		// the provisioner pod did not run, e.g. the api server was not reachable
+		return controller.ProvisioningNoChange
+	}
+	switch podErr.Reason {
+	case provisionerpod.ReasonInsufficientSpace:
+		return controller.ProvisioningReschedule
+	case provisionerpod.ReasonTransient:
+		// a timed out provisioner pod may have created the volume, it is provisioned again on the same node
+		return controller.ProvisioningInBackground
+	case provisionerpod.ReasonInvalid, provisionerpod.ReasonConflict:
+		return controller.ProvisioningFinished
+	}
+	return controller.ProvisioningReschedule
+}
+
 func (p *lvmProvisioner) createProvisionerPod(ctx context.Context, va volumeAction) (err error) {
 	if va.name == "" || va.path == "" || va.nodeName == "" {
 		return fmt.Errorf("invalid empty name or path or node")
@@ -233,7 +296,8 @@ func (p *lvmProvisioner) createProvisionerPod(ctx context.Context, va volumeActi
 
 	args := []string{}
 	if va.action == actionTypeCreate {
-		args = append(args, "createlv", "--lvsize", fmt.Sprintf("%d", va.size), "--devices", p.devicePattern, "--lvmtype", va.lvmType)
+		args = append(args, "createlv", "--lvsize", fmt.Sprintf("%d", va.size), "--lvmtype", va.lvmType)
+		args = append(args, p.deviceSelector.args()...)
 	}
 	if va.action == actionTypeDelete {
 		args = append(args, "deletelv")
@@ -242,170 +306,45 @@ func (p *lvmProvisioner) createProvisionerPod(ctx context.Context, va volumeActi
 	if va.isBlock {
 		args = append(args, "--block")
 	}
+	if va.action == actionTypeCreate && va.fsckPolicy != "" {
+		args = append(args, "--fsck-policy", va.fsckPolicy)
+	}
+	for _, tag := range va.tags {
+		args = append(args, "--tag", tag)
+	}
+	if va.fsLabel != "" {
+		args = append(args, "--fs-label", va.fsLabel)
+	}
+	if va.action == actionTypeCreate && p.keepFailedVolumes {
+		args = append(args, "--keep-on-failure")
+	}
 
-	klog.Infof("start provisionerPod with args:%s", args)
-	hostPathType := v1.HostPathDirectoryOrCreate
-	mountPropagation := v1.MountPropagationBidirectional
-	privileged := true
-	provisionerPod := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: string(va.action) + "-" + va.name,
-		},
-		Spec: v1.PodSpec{
-			RestartPolicy: v1.RestartPolicyNever,
-			NodeName:      va.nodeName,
-			Tolerations: []v1.Toleration{
-				{
-					Operator: v1.TolerationOpExists,
-				},
-			},
-			Containers: []v1.Container{
-				{
-					Name:    "csi-lvm-" + string(va.action),
-					Image:   p.provisionerImage,
-					Command: []string{"/csi-lvm-provisioner"},
-					Args:    args,
-					VolumeMounts: []v1.VolumeMount{
-						{
-							Name:             "data",
-							ReadOnly:         false,
-							MountPath:        p.lvDir,
-							MountPropagation: &mountPropagation,
-						},
-						{
-							Name:      "devices",
-							ReadOnly:  false,
-							MountPath: "/dev",
-						},
-						{
-							Name:      "modules",
-							ReadOnly:  false,
-							MountPath: "/lib/modules",
-						},
-						{
-							Name:             "lvmbackup",
-							ReadOnly:         false,
-							MountPath:        "/etc/lvm/backup",
-							MountPropagation: &mountPropagation,
-						},
-						{
-							Name:             "lvmcache",
-							ReadOnly:         false,
-							MountPath:        "/etc/lvm/cache",
-							MountPropagation: &mountPropagation,
-						},
-						{
-							Name:             "lvmlock",
-							ReadOnly:         false,
-							MountPath:        "/run/lock/lvm",
-							MountPropagation: &mountPropagation,
-						},
-					},
-					ImagePullPolicy: p.pullPolicy,
-					SecurityContext: &v1.SecurityContext{
-						Privileged: &privileged,
-					},
-					Resources: v1.ResourceRequirements{
-						Requests: v1.ResourceList{
-							"cpu":    resource.MustParse("50m"),
-							"memory": resource.MustParse("50Mi"),
-						},
-						Limits: v1.ResourceList{
-							"cpu":    resource.MustParse("100m"),
-							"memory": resource.MustParse("100Mi"),
-						},
-					},
-				},
-			},
-			Volumes: []v1.Volume{
-				{
-					Name: "data",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: p.lvDir,
-							Type: &hostPathType,
-						},
-					},
-				},
-				{
-					Name: "devices",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/dev",
-							Type: &hostPathType,
-						},
-					},
-				},
-				{
-					Name: "modules",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/lib/modules",
-							Type: &hostPathType,
-						},
-					},
-				},
-				{
-					Name: "lvmbackup",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/etc/lvm/backup",
-							Type: &hostPathType,
-						},
-					},
-				},
-				{
-					Name: "lvmcache",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/etc/lvm/cache",
-							Type: &hostPathType,
-						},
-					},
-				},
-				{
-					Name: "lvmlock",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/run/lock/lvm",
-							Type: &hostPathType,
-						},
-					},
-				},
-			},
-		},
-	}
-
-	// If it already exists due to some previous errors, the pod will be cleaned up later automatically
-	// https://github.com/rancher/local-path-provisioner/issues/27
-	_, err = p.kubeClient.CoreV1().Pods(p.namespace).Create(ctx, provisionerPod, metav1.CreateOptions{})
-	if err != nil && !k8serror.IsAlreadyExists(err) {
+	release, err := p.queue.acquire(ctx, va.nodeName, va.action)
+	if err != nil {
 		return err
 	}
+	defer release()
 
-	defer func() {
-		e := p.kubeClient.CoreV1().Pods(p.namespace).Delete(ctx, provisionerPod.Name, metav1.DeleteOptions{})
-		if e != nil {
-			klog.Errorf("unable to delete the provisioner pod: %v", e)
-		}
-	}()
-
-	completed := false
-	retrySeconds := 120
-	for i := 0; i < retrySeconds; i++ {
-		pod, err := p.kubeClient.CoreV1().Pods(p.namespace).Get(ctx, provisionerPod.Name, metav1.GetOptions{})
-		if err != nil {
-			klog.Errorf("error reading provisioner pod:%v", err)
-		} else if pod.Status.Phase == v1.PodSucceeded {
-			klog.Info("provisioner pod terminated successfully")
-			completed = true
-			break
-		}
-		klog.Infof("provisioner pod status:%s", pod.Status.Phase)
-		time.Sleep(1 * time.Second)
-	}
-	if !completed {
-		return fmt.Errorf("create process timeout after %v seconds", retrySeconds)
+	klog.Infof("start provisionerPod with args:%s", args)
+	err = provisionerpod.Run(ctx, p.kubeClient, provisionerpod.Spec{
+		Name:           string(va.action) + "-" + va.name,
+		Namespace:      p.namespace,
+		Container:      "csi-lvm-" + string(va.action),
+		NodeName:       va.nodeName,
+		Image:          p.provisionerImage,
+		PullPolicy:     p.pullPolicy,
+		ServiceAccount: p.serviceAccount,
+		Dir:            p.lvDir,
+		Args:           args,
+		// the mounts of all containers are checked before a volume is deleted,
+		// the mounts of the node before devices are added to the volume group on create
+		HostPID:   true,
+		Operation: string(uuid.NewUUID()),
+		Action:    string(va.action),
+		Volume:    va.name,
+	}, 120*time.Second)
+	if err != nil {
+		return err
 	}
 
 	klog.Infof("Volume %v has been %vd on %v:%v", va.name, va.action, va.nodeName, va.path)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/metal-stack/csi-lvm/internal/provisionerpod"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v10/controller"
+)
+
+func TestProvisioningState(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want controller.ProvisioningState
+	}{
+		{
+			name: "provisioner pod did not run",
+			err:  errors.New("connection refused"),
+			want: controller.ProvisioningNoChange,
+		},
+		{
+			name: "insufficient space",
+			err:  &provisionerpod.Error{Pod: "create-pvc-1", Reason: provisionerpod.ReasonInsufficientSpace},
+			want: controller.ProvisioningReschedule,
+		},
+		{
+			name: "wrapped insufficient space",
+			err:  fmt.Errorf("unable to create lv err:%w", &provisionerpod.Error{Pod: "create-pvc-1", Reason: provisionerpod.ReasonInsufficientSpace}),
+			want: controller.ProvisioningReschedule,
+		},
+		{
+			name: "transient",
+			err:  &provisionerpod.Error{Pod: "create-pvc-1", Reason: provisionerpod.ReasonTransient},
+			want: controller.ProvisioningInBackground,
+		},
+		{
+			name: "invalid",
+			err:  &provisionerpod.Error{Pod: "create-pvc-1", Reason: provisionerpod.ReasonInvalid},
+			want: controller.ProvisioningFinished,
+		},
+		{
+			name: "conflict",
+			err:  &provisionerpod.Error{Pod: "create-pvc-1", Reason: provisionerpod.ReasonConflict},
+			want: controller.ProvisioningFinished,
+		},
+		{
+			name: "unknown",
+			err:  &provisionerpod.Error{Pod: "create-pvc-1", Reason: provisionerpod.ReasonUnknown},
+			want: controller.ProvisioningReschedule,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := provisioningState(tt.err); got != tt.want {
+				t.Errorf("provisioningState() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
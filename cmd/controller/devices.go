@@ -0,0 +1,35 @@
+package main
+
+// deviceSelector holds the device selection which is passed to the provisioner pod.
+// All fields except the pattern are optional and only passed if set.
+type deviceSelector struct {
+	pattern    string
+	model      string
+	serial     string
+	rotational string
+	minSize    string
+	maxSize    string
+	transport  string
+}
+
+// args returns the createlv arguments for this selector
+func (s deviceSelector) args() []string {
+	args := []string{"--devices", s.pattern}
+	optional := []struct {
+		flag  string
+		value string
+	}{
+		{"--device-model", s.model},
+		{"--device-serial", s.serial},
+		{"--device-rotational", s.rotational},
+		{"--device-min-size", s.minSize},
+		{"--device-max-size", s.maxSize},
+		{"--device-transport", s.transport},
+	}
+	for _, o := range optional {
+		if o.value != "" {
+			args = append(args, o.flag, o.value)
+		}
+	}
+	return args
+}
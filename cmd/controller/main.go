@@ -4,11 +4,16 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
+	v1 "k8s.io/api/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	pvController "sigs.k8s.io/sig-storage-lib-external-provisioner/v10/controller"
 )
@@ -27,14 +32,41 @@ var (
 	defaultProvisionerImage      = "ghcr.io/metal-stack/csi-lvm-provisioner"
 	flagDevicePattern            = "device-pattern"
 	envDevicePattern             = "CSI_LVM_DEVICE_PATTERN"
+	flagDeviceModel              = "device-model"
+	envDeviceModel               = "CSI_LVM_DEVICE_MODEL"
+	flagDeviceSerial             = "device-serial"
+	envDeviceSerial              = "CSI_LVM_DEVICE_SERIAL"
+	flagDeviceRotational         = "device-rotational"
+	envDeviceRotational          = "CSI_LVM_DEVICE_ROTATIONAL"
+	flagDeviceMinSize            = "device-min-size"
+	envDeviceMinSize             = "CSI_LVM_DEVICE_MIN_SIZE"
+	flagDeviceMaxSize            = "device-max-size"
+	envDeviceMaxSize             = "CSI_LVM_DEVICE_MAX_SIZE"
+	flagDeviceTransport          = "device-transport"
+	envDeviceTransport           = "CSI_LVM_DEVICE_TRANSPORT"
 	flagDefaultLVMType           = "default-lvm-type"
 	envDefaultLVMType            = "CSI_LVM_DEFAULT_LVM_TYPE"
 	flagMountPoint               = "mountpoint"
 	envMountPoint                = "CSI_LVM_MOUNTPOINT"
 	flagProvisionerPodPullPolicy = "pull-policy"
 	envProvisionerPodPullPolicy  = "CSI_LVM_PULL_POLICY"
+	flagProvisionerPodSA         = "provisioner-service-account"
+	envProvisionerPodSA          = "CSI_LVM_PROVISIONER_SERVICE_ACCOUNT"
+	flagKeepFailedVolumes        = "keep-failed-volumes"
+	envKeepFailedVolumes         = "CSI_LVM_KEEP_FAILED_VOLUMES"
+	flagNodeConcurrency          = "node-concurrency"
+	envNodeConcurrency           = "CSI_LVM_NODE_CONCURRENCY"
+	flagNodeLease                = "node-lease"
+	envNodeLease                 = "CSI_LVM_NODE_LEASE"
+	flagForgetDeletedNodes       = "forget-volumes-of-deleted-nodes"
+	envForgetDeletedNodes        = "CSI_LVM_FORGET_VOLUMES_OF_DELETED_NODES"
+	flagMetricsAddress           = "metrics-address"
+	envMetricsAddress            = "CSI_LVM_METRICS_ADDRESS"
 )
 
+// nodeLeaseDuration after which the lease of a node held by a crashed replica is taken over
+const nodeLeaseDuration = 15 * time.Second
+
 func cmdNotFound(c *cli.Context, command string) {
 	panic(fmt.Errorf("unrecognized command: %s", command))
 }
@@ -76,6 +108,36 @@ func startCmd() *cli.Command {
 				Usage:   "Required. The pattern of the disk devices on the node to use",
 				EnvVars: []string{envDevicePattern},
 			},
+			&cli.StringFlag{
+				Name:    flagDeviceModel,
+				Usage:   "Optional. regular expression the model of the disk devices must match",
+				EnvVars: []string{envDeviceModel},
+			},
+			&cli.StringFlag{
+				Name:    flagDeviceSerial,
+				Usage:   "Optional. regular expression the serial of the disk devices must match",
+				EnvVars: []string{envDeviceSerial},
+			},
+			&cli.StringFlag{
+				Name:    flagDeviceRotational,
+				Usage:   "Optional. use only rotational (true) or non-rotational (false) disk devices",
+				EnvVars: []string{envDeviceRotational},
+			},
+			&cli.StringFlag{
+				Name:    flagDeviceMinSize,
+				Usage:   "Optional. the minimum size of the disk devices to use, e.g. 100Gi",
+				EnvVars: []string{envDeviceMinSize},
+			},
+			&cli.StringFlag{
+				Name:    flagDeviceMaxSize,
+				Usage:   "Optional. the maximum size of the disk devices to use, e.g. 4Ti",
+				EnvVars: []string{envDeviceMaxSize},
+			},
+			&cli.StringFlag{
+				Name:    flagDeviceTransport,
+				Usage:   "Optional. comma separated transports of the disk devices to use, e.g. nvme,sata",
+				EnvVars: []string{envDeviceTransport},
+			},
 			&cli.StringFlag{
 				Name:    flagDefaultLVMType,
 				Usage:   "Optional. the default lvm type to use, must be one of linear|striped|mirror",
@@ -94,6 +156,37 @@ func startCmd() *cli.Command {
 				EnvVars: []string{envProvisionerPodPullPolicy},
 				Value:   pullAlways,
 			},
+			&cli.StringFlag{
+				Name:    flagProvisionerPodSA,
+				Usage:   "Optional. the service account of the provisioner pod, required to read node annotations and to emit node and volume events",
+				EnvVars: []string{envProvisionerPodSA},
+			},
+			&cli.BoolFlag{
+				Name:    flagKeepFailedVolumes,
+				Usage:   "Optional. keep the logical volume and its mount of a failed provisioning on the node for inspection instead of rolling them back",
+				EnvVars: []string{envKeepFailedVolumes},
+			},
+			&cli.IntFlag{
+				Name:    flagNodeConcurrency,
+				Usage:   "Optional. the maximum number of provisioner pods running at the same time on a node, 0 is unlimited",
+				EnvVars: []string{envNodeConcurrency},
+			},
+			&cli.BoolFlag{
+				Name:    flagNodeLease,
+				Usage:   "Optional. share the node concurrency with all replicas of the controller by leases per node",
+				EnvVars: []string{envNodeLease},
+			},
+			&cli.BoolFlag{
+				Name:    flagForgetDeletedNodes,
+				Usage:   "Optional. delete released persistent volumes of nodes which do not exist anymore without cleaning up their logical volume",
+				EnvVars: []string{envForgetDeletedNodes},
+			},
+			&cli.StringFlag{
+				Name:    flagMetricsAddress,
+				Usage:   "Optional. the address to serve prometheus metrics on, disabled if empty",
+				EnvVars: []string{envMetricsAddress},
+				Value:   ":9090",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			if err := startDaemon(c); err != nil {
@@ -137,6 +230,15 @@ func startDaemon(c *cli.Context) error {
 	if devicePattern == "" {
 		return fmt.Errorf("invalid empty flag %v", flagDevicePattern)
 	}
+	selector := deviceSelector{
+		pattern:    devicePattern,
+		model:      c.String(flagDeviceModel),
+		serial:     c.String(flagDeviceSerial),
+		rotational: c.String(flagDeviceRotational),
+		minSize:    c.String(flagDeviceMinSize),
+		maxSize:    c.String(flagDeviceMaxSize),
+		transport:  c.String(flagDeviceTransport),
+	}
 
 	defaultLVMType := c.String(flagDefaultLVMType)
 	if defaultLVMType == "" {
@@ -151,11 +253,46 @@ func startDaemon(c *cli.Context) error {
 		return fmt.Errorf("invalid empty flag %v", flagProvisionerPodPullPolicy)
 	}
 
-	provisioner := NewLVMProvisioner(kubeClient, namespace, vgName, mountPoint, devicePattern, provisionerImage, defaultLVMType, pullPolicy)
+	serviceAccount := c.String(flagProvisionerPodSA)
+
+	nodeConcurrency := c.Int(flagNodeConcurrency)
+	if nodeConcurrency < 0 {
+		return fmt.Errorf("invalid flag %v %d, must not be negative", flagNodeConcurrency, nodeConcurrency)
+	}
+	var leases *nodeLeases
+	if c.Bool(flagNodeLease) {
+		if nodeConcurrency == 0 {
+			return fmt.Errorf("flag %v requires a limit of %v", flagNodeLease, flagNodeConcurrency)
+		}
+		identity, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("unable to get identity for node leases %w", err)
+		}
+		leases = &nodeLeases{
+			kubeClient: kubeClient,
+			namespace:  namespace,
+			identity:   identity,
+			duration:   nodeLeaseDuration,
+		}
+	}
+	queue := newNodeQueue(nodeConcurrency, leases)
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events(v1.NamespaceAll)})
+	eventRecorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "csi-lvm-controller"})
+
+	provisioner := NewLVMProvisioner(kubeClient, namespace, vgName, mountPoint, selector, provisionerImage, defaultLVMType, pullPolicy, serviceAccount, c.Bool(flagKeepFailedVolumes), queue, c.Bool(flagForgetDeletedNodes), eventRecorder)
+
+	serveMetrics(c.String(flagMetricsAddress))
 
 	ctx := context.Background()
 	logger := klog.FromContext(ctx)
 
+	// a failure is logged only, the pods are adopted or replaced when their operation is retried anyway
+	if err := collectProvisionerPods(ctx, kubeClient, namespace); err != nil {
+		klog.Errorf("unable to collect leftover provisioner pods: %v", err)
+	}
+
 	pc := pvController.NewProvisionController(
 		logger,
 		kubeClient,
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "csi_lvm"
+
+var (
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_queue_depth",
+		Help:      "Number of operations waiting for a free slot of a node.",
+	}, []string{"node"})
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_queue_wait_seconds",
+		Help:      "Time operations waited for a free slot of their node by action.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"action"})
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, queueWait)
+}
+
+// serveMetrics serves the prometheus metrics on the given address in the background
+func serveMetrics(address string) {
+	if address == "" {
+		klog.Info("metrics are disabled")
+		return
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		klog.Infof("serving metrics on %s", address)
+		err := http.ListenAndServe(address, nil)
+		if err != nil {
+			klog.Errorf("unable to serve metrics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// nodeQueue limits the concurrent provisioner pods per node, parallel lvm commands on one node race on the lvm locks
+// and on the free space of the volume group. With leases, the limit is shared by all replicas of the controller.
+type nodeQueue struct {
+	// concurrency is the number of slots per node, 0 is unlimited
+	concurrency int
+	// leases coordinates the replicas of the controller, nil if only the replica itself is limited
+	leases *nodeLeases
+
+	mu    sync.Mutex
+	slots map[string]chan int
+}
+
+// nodeLeases holds one lease per slot of a node in the namespace of the controller
+type nodeLeases struct {
+	kubeClient clientset.Interface
+	namespace  string
+	// identity of this replica of the controller
+	identity string
+	// duration after which a lease of a crashed replica is taken over
+	duration time.Duration
+}
+
+func newNodeQueue(concurrency int, leases *nodeLeases) *nodeQueue {
+	return &nodeQueue{
+		concurrency: concurrency,
+		leases:      leases,
+		slots:       map[string]chan int{},
+	}
+}
+
+func (q *nodeQueue) nodeSlots(node string) chan int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	slots, ok := q.slots[node]
+	if !ok {
+		slots = make(chan int, q.concurrency)
+		for i := 0; i < q.concurrency; i++ {
+			slots <- i
+		}
+		q.slots[node] = slots
+	}
+	return slots
+}
+
+// acquire waits for a free slot of the node, the returned release must be called after the operation
+func (q *nodeQueue) acquire(ctx context.Context, node string, action actionType) (release func(), err error) {
+	start := time.Now()
+	queueDepth.WithLabelValues(node).Inc()
+	defer func() {
+		queueDepth.WithLabelValues(node).Dec()
+		queueWait.WithLabelValues(string(action)).Observe(time.Since(start).Seconds())
+	}()
+
+	if q.concurrency == 0 {
+		return func() {}, nil
+	}
+	slots := q.nodeSlots(node)
+	var slot int
+	select {
+	case slot = <-slots:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for node %s canceled err:%w", node, ctx.Err())
+	}
+	if q.leases == nil {
+		return func() { slots <- slot }, nil
+	}
+
+	releaseLease, err := q.leases.acquire(ctx, node, q.concurrency)
+	if err != nil {
+		slots <- slot
+		return nil, err
+	}
+	return func() {
+		releaseLease()
+		slots <- slot
+	}, nil
+}
+
+func (l *nodeLeases) name(node string, slot int) string {
+	return fmt.Sprintf("csi-lvm-%s-%d", node, slot)
+}
+
+// acquire waits until one of the leases of the node is free and holds it until released
+func (l *nodeLeases) acquire(ctx context.Context, node string, slots int) (release func(), err error) {
+	retry := l.duration / 10
+	for {
+		for slot := 0; slot < slots; slot++ {
+			name := l.name(node, slot)
+			ok, err := l.tryAcquire(ctx, name)
+			if err != nil {
+				klog.Errorf("unable to acquire lease %s: %v", name, err)
+				continue
+			}
+			if ok {
+				return l.hold(name), nil
+			}
+		}
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for a lease of node %s canceled err:%w", node, ctx.Err())
+		}
+	}
+}
+
+// tryAcquire takes the lease if it is free or expired
+func (l *nodeLeases) tryAcquire(ctx context.Context, name string) (bool, error) {
+	leases := l.kubeClient.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(l.duration.Seconds())
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if k8serror.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: l.namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if k8serror.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if held(lease) {
+		return false, nil
+	}
+	lease.Spec.HolderIdentity = &l.identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if k8serror.IsConflict(err) {
+		// another replica was faster
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// held returns true if the lease is held and not expired, also by this replica for another operation
+func held(lease *coordinationv1.Lease) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" {
+		return false
+	}
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	return time.Now().Before(spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
+
+// hold renews the lease until the returned release is called, which frees it for other replicas
+func (l *nodeLeases) hold(name string) (release func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.duration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.update(ctx, name, func(lease *coordinationv1.Lease) {
+					now := metav1.NewMicroTime(time.Now())
+					lease.Spec.RenewTime = &now
+				}); err != nil {
+					klog.Errorf("unable to renew lease %s: %v", name, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if err := l.update(context.Background(), name, func(lease *coordinationv1.Lease) {
+			lease.Spec.HolderIdentity = nil
+		}); err != nil {
+			klog.Errorf("unable to release lease %s, it expires after %s: %v", name, l.duration, err)
+		}
+	}
+}
+
+// update modifies the lease if it is still held by this replica
+func (l *nodeLeases) update(ctx context.Context, name string, modify func(*coordinationv1.Lease)) error {
+	leases := l.kubeClient.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		return fmt.Errorf("lease %s is not held by %s anymore", name, l.identity)
+	}
+	modify(lease)
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
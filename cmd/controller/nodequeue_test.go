@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeQueue(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		// nodes of the operations which hold their slot
+		held []string
+		// node of the next operation
+		node string
+		// blocked is true if the next operation waits for a slot
+		blocked bool
+	}{
+		{name: "free slot", concurrency: 1, node: "node-a"},
+		{name: "node is busy", concurrency: 1, held: []string{"node-a"}, node: "node-a", blocked: true},
+		{name: "other node is not limited", concurrency: 1, held: []string{"node-a"}, node: "node-b"},
+		{name: "second slot", concurrency: 2, held: []string{"node-a"}, node: "node-a"},
+		{name: "all slots busy", concurrency: 2, held: []string{"node-a", "node-a"}, node: "node-a", blocked: true},
+		{name: "unlimited", concurrency: 0, held: []string{"node-a", "node-a", "node-a"}, node: "node-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newNodeQueue(tt.concurrency, nil)
+			var releases []func()
+			for _, node := range tt.held {
+				release, err := q.acquire(context.Background(), node, actionTypeCreate)
+				if err != nil {
+					t.Fatal(err)
+				}
+				releases = append(releases, release)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			release, err := q.acquire(ctx, tt.node, actionTypeDelete)
+			if tt.blocked != (err != nil) {
+				t.Fatalf("acquire() error = %v, blocked %v", err, tt.blocked)
+			}
+			if !tt.blocked {
+				release()
+				return
+			}
+
+			// a released slot is free for the next operation
+			releases[0]()
+			release, err = q.acquire(context.Background(), tt.node, actionTypeDelete)
+			if err != nil {
+				t.Fatalf("acquire() after release error = %v", err)
+			}
+			release()
+		})
+	}
+}
+
+func TestNodeQueueLeases(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	newQueue := func(identity string) *nodeQueue {
+		return newNodeQueue(1, &nodeLeases{
+			kubeClient: kubeClient,
+			namespace:  "csi-lvm",
+			identity:   identity,
+			duration:   time.Second,
+		})
+	}
+	a, b := newQueue("replica-a"), newQueue("replica-b")
+
+	release, err := a.acquire(context.Background(), "node-a", actionTypeCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the slot of the node is held by the other replica
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = b.acquire(ctx, "node-a", actionTypeCreate)
+	if err == nil {
+		t.Fatal("acquire() of a held lease succeeded")
+	}
+
+	// other nodes have their own leases
+	releaseOther, err := b.acquire(context.Background(), "node-b", actionTypeCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther()
+
+	release()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	release, err = b.acquire(ctx, "node-a", actionTypeCreate)
+	if err != nil {
+		t.Fatalf("acquire() of a released lease error = %v", err)
+	}
+	release()
+}
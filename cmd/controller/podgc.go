@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/metal-stack/csi-lvm/internal/provisionerpod"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// annSelectedNode is set on a claim by the scheduler for volumes with volumeBindingMode WaitForFirstConsumer
+const annSelectedNode = "volume.kubernetes.io/selected-node"
+
+// collectProvisionerPods deletes the provisioner pods left over by a controller which crashed or was rescheduled in the middle of an operation.
+// Pods of operations which are still pending on their node are kept, they are adopted when the library retries the operation.
+func collectProvisionerPods(ctx context.Context, kubeClient clientset.Interface, namespace string) error {
+	pods, err := kubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: provisionerpod.LabelOperation})
+	if err != nil {
+		return fmt.Errorf("unable to list provisioner pods err:%w", err)
+	}
+	if len(pods.Items) == 0 {
+		return nil
+	}
+
+	claims, err := kubeClient.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list claims err:%w", err)
+	}
+	// the library names the volume of a claim after its uid
+	claimsByVolume := map[string]*v1.PersistentVolumeClaim{}
+	for i := range claims.Items {
+		claimsByVolume["pvc-"+string(claims.Items[i].UID)] = &claims.Items[i]
+	}
+
+	for _, pod := range pods.Items {
+		operation := pod.Labels[provisionerpod.LabelOperation]
+		action := pod.Labels[provisionerpod.LabelAction]
+		name := pod.Labels[provisionerpod.LabelVolume]
+		ok, err := pendingOperation(ctx, kubeClient, &pod, claimsByVolume[name])
+		if err != nil {
+			klog.Errorf("unable to check provisioner pod %s of operation %s: %v", pod.Name, operation, err)
+			continue
+		}
+		if ok {
+			klog.Infof("keeping provisioner pod %s of operation %s, it is adopted when the %s of volume %s is retried", pod.Name, operation, action, name)
+			continue
+		}
+		klog.Infof("deleting stale provisioner pod %s of operation %s, %s of volume %s phase:%s", pod.Name, operation, action, name, pod.Status.Phase)
+		err = kubeClient.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(pod.UID))})
+		if err != nil && !k8serror.IsNotFound(err) {
+			klog.Errorf("unable to delete stale provisioner pod %s: %v", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// pendingOperation returns true if the operation of the provisioner pod is still to be done on the node of the pod:
+// a claim waits for its volume on this node or a released volume of this node waits for its deletion
+func pendingOperation(ctx context.Context, kubeClient clientset.Interface, pod *v1.Pod, claim *v1.PersistentVolumeClaim) (bool, error) {
+	name := pod.Labels[provisionerpod.LabelVolume]
+	if pod.DeletionTimestamp != nil || name == "" {
+		return false, nil
+	}
+	pv, err := kubeClient.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+	if k8serror.IsNotFound(err) {
+		pv = nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch actionType(pod.Labels[provisionerpod.LabelAction]) {
+	case actionTypeCreate:
+		if pv != nil || claim == nil || claim.DeletionTimestamp != nil || claim.Spec.VolumeName != "" {
+			return false, nil
+		}
+		return claim.Annotations[annSelectedNode] == pod.Spec.NodeName, nil
+	case actionTypeDelete:
+		if pv == nil || pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+			return false, nil
+		}
+		if pv.Status.Phase != v1.VolumeReleased && pv.Status.Phase != v1.VolumeFailed {
+			return false, nil
+		}
+		return volume.Node(pv) == pod.Spec.NodeName, nil
+	}
+	return false, nil
+}
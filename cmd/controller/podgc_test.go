@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/metal-stack/csi-lvm/internal/provisionerpod"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPendingOperation(t *testing.T) {
+	now := metav1.Now()
+	pod := func(action actionType) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   string(action) + "-pvc-1",
+				Labels: map[string]string{provisionerpod.LabelAction: string(action), provisionerpod.LabelVolume: "pvc-1"},
+			},
+			Spec: v1.PodSpec{NodeName: "node-a"},
+		}
+	}
+	deletedPod := pod(actionTypeCreate)
+	deletedPod.DeletionTimestamp = &now
+	claim := func(node, volumeName string) *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default", Annotations: map[string]string{annSelectedNode: node}},
+			Spec:       v1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+		}
+	}
+	deletedClaim := claim("node-a", "")
+	deletedClaim.DeletionTimestamp = &now
+	pv := func(node string, policy v1.PersistentVolumeReclaimPolicy, phase v1.PersistentVolumePhase) *v1.PersistentVolume {
+		pv := volume.PersistentVolume("pvc-1", "/tmp/csi-lvm", node, volume.Metadata{ReclaimPolicy: policy})
+		pv.Status.Phase = phase
+		return pv
+	}
+
+	tests := []struct {
+		name  string
+		pod   *v1.Pod
+		claim *v1.PersistentVolumeClaim
+		pv    *v1.PersistentVolume
+		want  bool
+	}{
+		{name: "claim waits on this node", pod: pod(actionTypeCreate), claim: claim("node-a", ""), want: true},
+		{name: "claim rescheduled to another node", pod: pod(actionTypeCreate), claim: claim("node-b", "")},
+		{name: "claim bound", pod: pod(actionTypeCreate), claim: claim("node-a", "pvc-1")},
+		{name: "claim deleted", pod: pod(actionTypeCreate), claim: deletedClaim},
+		{name: "claim gone", pod: pod(actionTypeCreate)},
+		{name: "volume provisioned", pod: pod(actionTypeCreate), claim: claim("node-a", ""), pv: pv("node-a", v1.PersistentVolumeReclaimDelete, v1.VolumePending)},
+		{name: "pod deleted", pod: deletedPod, claim: claim("node-a", "")},
+		{name: "released volume waits for deletion", pod: pod(actionTypeDelete), pv: pv("node-a", v1.PersistentVolumeReclaimDelete, v1.VolumeReleased), want: true},
+		{name: "failed deletion", pod: pod(actionTypeDelete), pv: pv("node-a", v1.PersistentVolumeReclaimDelete, v1.VolumeFailed), want: true},
+		{name: "volume deleted", pod: pod(actionTypeDelete)},
+		{name: "volume bound again", pod: pod(actionTypeDelete), pv: pv("node-a", v1.PersistentVolumeReclaimDelete, v1.VolumeBound)},
+		{name: "volume retained", pod: pod(actionTypeDelete), pv: pv("node-a", v1.PersistentVolumeReclaimRetain, v1.VolumeReleased)},
+		{name: "volume of another node", pod: pod(actionTypeDelete), pv: pv("node-b", v1.PersistentVolumeReclaimDelete, v1.VolumeReleased)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tt.pv != nil {
+				objects = append(objects, tt.pv)
+			}
+			client := fake.NewSimpleClientset(objects...)
+			got, err := pendingOperation(context.Background(), client, tt.pod, tt.claim)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("pendingOperation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/metal-stack/csi-lvm/internal/provisionerpod"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+const (
+	flagKubeconfig       = "kubeconfig"
+	flagNamespace        = "namespace"
+	flagVGName           = "vgname"
+	flagMountPoint       = "mountpoint"
+	flagProvisionerImage = "provisioner-image"
+	flagPullPolicy       = "pull-policy"
+	flagServiceAccount   = "service-account"
+	flagReviverSelector  = "reviver-selector"
+	flagTimeout          = "timeout"
+	flagVerbose          = "verbose"
+	flagNode             = "node"
+)
+
+// ctl runs the commands of the provisioner on the nodes in provisioner pods
+type ctl struct {
+	client          clientset.Interface
+	namespace       string
+	vgName          string
+	dir             string
+	image           string
+	pullPolicy      v1.PullPolicy
+	serviceAccount  string
+	reviverSelector string
+	timeout         time.Duration
+}
+
+func newCtl(c *cli.Context) (*ctl, error) {
+	for _, flag := range []string{flagNamespace, flagVGName, flagMountPoint, flagProvisionerImage} {
+		if c.String(flag) == "" {
+			return nil, fmt.Errorf("invalid empty flag %v", flag)
+		}
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = c.String(flagKubeconfig)
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get client config %w", err)
+	}
+	client, err := clientset.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get k8s client %w", err)
+	}
+	pullPolicy := v1.PullAlways
+	if strings.ToLower(c.String(flagPullPolicy)) == "ifnotpresent" {
+		pullPolicy = v1.PullIfNotPresent
+	}
+	return &ctl{
+		client:          client,
+		namespace:       c.String(flagNamespace),
+		vgName:          c.String(flagVGName),
+		dir:             c.String(flagMountPoint),
+		image:           c.String(flagProvisionerImage),
+		pullPolicy:      pullPolicy,
+		serviceAccount:  c.String(flagServiceAccount),
+		reviverSelector: c.String(flagReviverSelector),
+		timeout:         c.Duration(flagTimeout),
+	}, nil
+}
+
+// run runs a command in a provisioner pod on the node and returns its log, the provisioner binary if command is empty
+func (t *ctl) run(ctx context.Context, node, action string, command []string, args ...string) (string, error) {
+	return provisionerpod.Output(ctx, t.client, provisionerpod.Spec{
+		Name:           "csi-lvmctl-" + action + "-" + rand.String(5),
+		Namespace:      t.namespace,
+		Container:      "csi-lvmctl-" + action,
+		NodeName:       node,
+		Image:          t.image,
+		PullPolicy:     t.pullPolicy,
+		ServiceAccount: t.serviceAccount,
+		Dir:            t.dir,
+		Command:        command,
+		Args:           args,
+	}, t.timeout)
+}
+
+// localPVs returns the persistent volumes mounted in the directory of csi-lvm by node
+func (t *ctl) localPVs(ctx context.Context) (map[string][]*v1.PersistentVolume, error) {
+	pvs, err := t.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list persistent volumes err:%w", err)
+	}
+	result := map[string][]*v1.PersistentVolume{}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.Local == nil || path.Dir(pv.Spec.Local.Path) != t.dir {
+			continue
+		}
+		node := volume.Node(pv)
+		result[node] = append(result[node], pv)
+	}
+	return result, nil
+}
+
+// nodes returns the node given by flag, otherwise all nodes running the reviver or having persistent volumes of csi-lvm
+func (t *ctl) nodes(ctx context.Context, c *cli.Context) ([]string, error) {
+	if node := c.String(flagNode); node != "" {
+		return []string{node}, nil
+	}
+	pods, err := t.client.CoreV1().Pods(t.namespace).List(ctx, metav1.ListOptions{LabelSelector: t.reviverSelector})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list reviver pods err:%w", err)
+	}
+	var nodes []string
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName != "" {
+			nodes = append(nodes, pod.Spec.NodeName)
+		}
+	}
+	pvs, err := t.localPVs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for node := range pvs {
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	slices.Sort(nodes)
+	return slices.Compact(nodes), nil
+}
+
+// requiredNode returns the node given by flag for commands which change a node
+func requiredNode(c *cli.Context) (string, error) {
+	node := c.String(flagNode)
+	if node == "" {
+		return "", fmt.Errorf("invalid empty flag %v", flagNode)
+	}
+	return node, nil
+}
+
+func nodeFlag(usage string) cli.Flag {
+	return &cli.StringFlag{
+		Name:  flagNode,
+		Usage: usage,
+	}
+}
+
+func main() {
+	a := cli.NewApp()
+	a.Name = "csi-lvmctl"
+	a.Usage = "inspect and repair the volumes of csi-lvm through the kubernetes api"
+	a.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    flagKubeconfig,
+			Usage:   "Optional. the kubeconfig to use, the default loading rules apply if empty",
+			EnvVars: []string{"KUBECONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    flagNamespace,
+			Usage:   "Required. the namespace csi-lvm is running in, the provisioner pods are started there",
+			EnvVars: []string{"CSI_LVM_PROVISIONER_NAMESPACE"},
+			Value:   "csi-lvm",
+		},
+		&cli.StringFlag{
+			Name:    flagVGName,
+			Usage:   "Required. LVM volume group name",
+			EnvVars: []string{"CSI_LVM_VG_NAME"},
+			Value:   "csi-lvm",
+		},
+		&cli.StringFlag{
+			Name:    flagMountPoint,
+			Usage:   "Required. the mountpoint on the nodes where the volumes get mounted",
+			EnvVars: []string{"CSI_LVM_MOUNTPOINT"},
+			Value:   "/tmp/csi-lvm",
+		},
+		&cli.StringFlag{
+			Name:    flagProvisionerImage,
+			Usage:   "Required. the provisioner image to run on the nodes",
+			EnvVars: []string{"CSI_LVM_PROVISIONER_IMAGE"},
+			Value:   "ghcr.io/metal-stack/csi-lvm-provisioner",
+		},
+		&cli.StringFlag{
+			Name:    flagPullPolicy,
+			Usage:   "Optional. the pull policy for the provisioner pods, can be Always|IfNotPresent",
+			EnvVars: []string{"CSI_LVM_PULL_POLICY"},
+			Value:   "ifnotpresent",
+		},
+		&cli.StringFlag{
+			Name:  flagServiceAccount,
+			Usage: "Optional. the service account of the provisioner pods, it must be allowed to read persistent volumes to find orphans and to create them to recover and adopt volumes",
+			Value: "csi-lvm-recover",
+		},
+		&cli.StringFlag{
+			Name:  flagReviverSelector,
+			Usage: "Optional. the label selector of the reviver pods",
+			Value: "app=csi-lvm-reviver",
+		},
+		&cli.DurationFlag{
+			Name:  flagTimeout,
+			Usage: "Optional. the time to wait for a provisioner pod or the restart of a reviver",
+			Value: 2 * time.Minute,
+		},
+		&cli.BoolFlag{
+			Name:  flagVerbose,
+			Usage: "Optional. log the progress of the provisioner pods",
+		},
+	}
+	a.Before = func(c *cli.Context) error {
+		if !c.Bool(flagVerbose) {
+			c.Context = klog.NewContext(c.Context, logr.Discard())
+		}
+		return nil
+	}
+	a.Commands = []*cli.Command{
+		volumesCmd(),
+		capacityCmd(),
+		orphansCmd(),
+		reviveCmd(),
+		recoverCmd(),
+		adoptCmd(),
+	}
+
+	if err := a.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	flagGracePeriod = "grace-period"
+	flagRecreatePVs = "recreate-pvs"
+	flagDryRun      = "dry-run"
+	flagLVName      = "lvname"
+	flagPVCNS       = "pvc-namespace"
+	flagPVCName     = "pvc-name"
+)
+
+// klogLine matches the header of log lines of the provisioner, they are mixed into the output of the provisioner pods
+var klogLine = regexp.MustCompile(`^[IWEF]\d{4} \d{2}:\d{2}:\d{2}\.\d+ `)
+
+// output returns the lines of the log of a provisioner pod which were printed by the command
+func output(log string) []string {
+	var lines []string
+	for _, line := range strings.Split(log, "\n") {
+		if line == "" || klogLine.MatchString(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// printOutput prints the output of a provisioner pod prefixed with the node, the complete log if it failed
+func printOutput(node, log string, err error) {
+	lines := output(log)
+	if err != nil {
+		lines = strings.Split(strings.TrimSpace(log), "\n")
+	}
+	for _, line := range lines {
+		if line != "" {
+			fmt.Printf("%s: %s\n", node, line)
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s: %v\n", node, err)
+	}
+}
+
+func orphansCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "orphans",
+		Usage: "find logical volumes and mountpoints without a persistent volume",
+		Flags: []cli.Flag{
+			nodeFlag("Optional. only find the orphans of this node"),
+			&cli.DurationFlag{
+				Name:  flagGracePeriod,
+				Usage: "Optional. only report orphans older than this, volumes are created before their persistent volume",
+				Value: time.Hour,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			t, err := newCtl(c)
+			if err != nil {
+				return err
+			}
+			nodes, err := t.nodes(c.Context, c)
+			if err != nil {
+				return err
+			}
+			failed := 0
+			for _, node := range nodes {
+				log, err := t.run(c.Context, node, "orphans", nil, "cleanorphans", "--dry-run",
+					"--vgname", t.vgName, "--directory", t.dir, "--grace-period", c.Duration(flagGracePeriod).String())
+				if err != nil {
+					failed++
+				}
+				printOutput(node, log, err)
+			}
+			if failed > 0 {
+				return fmt.Errorf("unable to find the orphans of %d nodes", failed)
+			}
+			return nil
+		},
+	}
+}
+
+func reviveCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "revive",
+		Usage: "restart the reviver of a node and wait until it mounted all volumes",
+		Flags: []cli.Flag{
+			nodeFlag("Required. the node to revive"),
+		},
+		Action: func(c *cli.Context) error {
+			t, err := newCtl(c)
+			if err != nil {
+				return err
+			}
+			node, err := requiredNode(c)
+			if err != nil {
+				return err
+			}
+			return t.restartReviver(c.Context, node)
+		},
+	}
+}
+
+// restartReviver deletes the reviver pod of the node, its daemonset creates a new one which revives all volumes before it becomes ready
+func (t *ctl) restartReviver(ctx context.Context, node string) error {
+	pods := t.client.CoreV1().Pods(t.namespace)
+	list := func() ([]v1.Pod, error) {
+		result, err := pods.List(ctx, metav1.ListOptions{
+			LabelSelector: t.reviverSelector,
+			FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node).String(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list reviver pods err:%w", err)
+		}
+		return result.Items, nil
+	}
+	old, err := list()
+	if err != nil {
+		return err
+	}
+	if len(old) == 0 {
+		return fmt.Errorf("no reviver pod runs on node %s, use recover instead", node)
+	}
+	var oldUIDs []types.UID
+	for _, pod := range old {
+		oldUIDs = append(oldUIDs, pod.UID)
+		err := pods.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to delete reviver pod %s err:%w", pod.Name, err)
+		}
+		fmt.Printf("%s: reviver pod %s deleted\n", node, pod.Name)
+	}
+
+	err = wait.PollUntilContextTimeout(ctx, 2*time.Second, t.timeout, true, func(ctx context.Context) (bool, error) {
+		current, err := list()
+		if err != nil {
+			return false, err
+		}
+		for _, pod := range current {
+			if slices.Contains(oldUIDs, pod.UID) || pod.DeletionTimestamp != nil {
+				continue
+			}
+			for _, condition := range pod.Status.Conditions {
+				if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+					fmt.Printf("%s: reviver pod %s is ready, all volumes are mounted\n", node, pod.Name)
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("reviver of node %s is not ready after %s, check its log and events: %w", node, t.timeout, err)
+	}
+	return nil
+}
+
+// reconcileResult is the result printed by revivelvs --once
+type reconcileResult struct {
+	Volumes  int      `json:"volumes"`
+	Mounted  int      `json:"mounted"`
+	Repaired []string `json:"repaired"`
+	Drift    []string `json:"drift"`
+	Pending  []string `json:"pending"`
+	Error    string   `json:"error"`
+}
+
+func recoverCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "recover",
+		Usage: "activate the volumegroup of a node and mount all volumes, like the manual recovery, e.g. if no reviver runs on the node",
+		Flags: []cli.Flag{
+			nodeFlag("Required. the node to recover"),
+			&cli.BoolFlag{
+				Name:  flagRecreatePVs,
+				Usage: "Optional. recreate missing persistent volumes from the tags of the logical volumes afterwards, e.g. after the loss of the cluster",
+			},
+			&cli.BoolFlag{
+				Name:  flagDryRun,
+				Usage: "Optional. only list the persistent volumes which would be recreated",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			t, err := newCtl(c)
+			if err != nil {
+				return err
+			}
+			node, err := requiredNode(c)
+			if err != nil {
+				return err
+			}
+			// the same steps as the reviver on startup: vgscan, vgchange -ay, activate and mount every logical volume
+			log, err := t.run(c.Context, node, "recover", nil, "revivelvs", "--once", "--vgname", t.vgName, "--directory", t.dir)
+			var result reconcileResult
+			parseErr := decodeOutput(log, &result)
+			if parseErr != nil {
+				printOutput(node, log, err)
+				return fmt.Errorf("recovery of node %s failed: %w", node, parseErr)
+			}
+			fmt.Printf("%s: %d volumes, %d mounted, %d mounted again\n", node, result.Volumes, result.Mounted, len(result.Repaired))
+			for _, name := range result.Repaired {
+				fmt.Printf("%s: %s mounted again\n", node, name)
+			}
+			for _, drift := range result.Drift {
+				fmt.Printf("%s: %s\n", node, drift)
+			}
+			if result.Error != "" {
+				return fmt.Errorf("recovery of node %s failed: %s", node, result.Error)
+			}
+			if len(result.Pending) > 0 {
+				return fmt.Errorf("recovery of node %s incomplete, not mounted: %s", node, strings.Join(result.Pending, ","))
+			}
+			if err != nil {
+				return fmt.Errorf("recovery of node %s failed: %w", node, err)
+			}
+
+			if !c.Bool(flagRecreatePVs) {
+				return nil
+			}
+			args := []string{"recoverpvs", "--vgname", t.vgName, "--directory", t.dir}
+			if c.Bool(flagDryRun) {
+				args = append(args, "--dry-run")
+			}
+			log, err = t.run(c.Context, node, "recoverpvs", nil, args...)
+			printOutput(node, log, err)
+			if err != nil {
+				return fmt.Errorf("unable to recreate the persistent volumes of node %s: %w", node, err)
+			}
+			return nil
+		},
+	}
+}
+
+func adoptCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "adopt",
+		Usage: "adopt a logical volume created by hand on a node as persistent volume of an unbound claim",
+		Flags: []cli.Flag{
+			nodeFlag("Required. the node of the logical volume"),
+			&cli.StringFlag{
+				Name:  flagLVName,
+				Usage: "Required. the name of the logical volume, it becomes the name of the persistent volume",
+			},
+			&cli.StringFlag{
+				Name:  flagPVCNS,
+				Usage: "Required. the namespace of the claim",
+			},
+			&cli.StringFlag{
+				Name:  flagPVCName,
+				Usage: "Required. the name of the claim",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			t, err := newCtl(c)
+			if err != nil {
+				return err
+			}
+			node, err := requiredNode(c)
+			if err != nil {
+				return err
+			}
+			for _, flag := range []string{flagLVName, flagPVCNS, flagPVCName} {
+				if c.String(flag) == "" {
+					return fmt.Errorf("invalid empty flag %v", flag)
+				}
+			}
+			log, err := t.run(c.Context, node, "adopt", nil, "adoptlv", "--vgname", t.vgName, "--directory", t.dir,
+				"--lvname", c.String(flagLVName), "--pvc-namespace", c.String(flagPVCNS), "--pvc-name", c.String(flagPVCName))
+			printOutput(node, log, err)
+			if err != nil {
+				return fmt.Errorf("unable to adopt lv %s on node %s: %w", c.String(flagLVName), node, err)
+			}
+			return nil
+		},
+	}
+}
+
+// decodeOutput reads the json printed by the command from the log of a provisioner pod
+func decodeOutput(log string, v any) error {
+	for _, line := range output(log) {
+		if strings.HasPrefix(line, "{") {
+			return json.Unmarshal([]byte(line), v)
+		}
+	}
+	return fmt.Errorf("no result in the log of the provisioner pod")
+}
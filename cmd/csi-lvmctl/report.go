@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/metal-stack/csi-lvm/internal/status"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// nodeReport is the status of the volumegroup on a node
+type nodeReport struct {
+	node   string
+	status status.Report
+	err    error
+}
+
+// inspect runs the status subcommand of the provisioner on a node
+func (t *ctl) inspect(ctx context.Context, node string) nodeReport {
+	report := nodeReport{node: node}
+	log, err := t.run(ctx, node, "status", nil, "status", "--output", "json", "--vgname", t.vgName, "--directory", t.dir)
+	if err != nil {
+		report.err = err
+		return report
+	}
+	report.err = decodeOutput(log, &report.status)
+	return report
+}
+
+// inspectAll inspects the nodes in parallel
+func (t *ctl) inspectAll(ctx context.Context, nodes []string) []nodeReport {
+	reports := make([]nodeReport, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reports[i] = t.inspect(ctx, node)
+		}()
+	}
+	wg.Wait()
+	return reports
+}
+
+func volumesCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "volumes",
+		Usage: "list the volumes of csi-lvm per node with size, type and usage",
+		Flags: []cli.Flag{
+			nodeFlag("Optional. only list the volumes of this node"),
+		},
+		Action: func(c *cli.Context) error {
+			t, err := newCtl(c)
+			if err != nil {
+				return err
+			}
+			nodes, err := t.nodes(c.Context, c)
+			if err != nil {
+				return err
+			}
+			pvs, err := t.localPVs(c.Context)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NODE\tVOLUME\tCLAIM\tSIZE\tTYPE\tMODE\tUSED\tSTATUS")
+			for _, report := range t.inspectAll(c.Context, nodes) {
+				if report.err != nil {
+					fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t%v\n", report.node, report.err)
+					continue
+				}
+				printVolumes(w, report, pvs[report.node])
+			}
+			return w.Flush()
+		},
+	}
+}
+
+// printVolumes prints the logical volumes of csi-lvm and the persistent volumes of a node
+func printVolumes(w *tabwriter.Writer, report nodeReport, pvs []*v1.PersistentVolume) {
+	byName := map[string]*v1.PersistentVolume{}
+	for _, pv := range pvs {
+		byName[pv.Name] = pv
+	}
+	for _, lv := range report.status.LVs {
+		pv := byName[lv.Name]
+		delete(byName, lv.Name)
+		claim := lv.Claim
+		if pv != nil && pv.Spec.ClaimRef != nil {
+			claim = pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+		}
+		mode := "filesystem"
+		if lv.Block {
+			mode = "block"
+		}
+		used := "-"
+		if lv.Usage != nil && lv.Usage.Size > 0 {
+			used = fmt.Sprintf("%s (%d%%)", formatBytes(lv.Usage.Used), 100*lv.Usage.Used/lv.Usage.Size)
+		}
+		var state []string
+		switch {
+		case !lv.Active:
+			state = append(state, "inactive")
+		case lv.Mounted:
+			state = append(state, "mounted")
+		default:
+			state = append(state, "not mounted")
+		}
+		if lv.Health != "" {
+			state = append(state, lv.Health)
+		}
+		if pv == nil {
+			state = append(state, "no persistent volume")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", report.node, lv.Name, valueOrDash(claim), formatBytes(lv.Size), lv.Type, mode, used, strings.Join(state, ","))
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		pv := byName[name]
+		claim := ""
+		if pv.Spec.ClaimRef != nil {
+			claim = pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t-\t-\t-\tlogical volume missing\n", report.node, name, valueOrDash(claim), capacity.String())
+	}
+}
+
+func capacityCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "capacity",
+		Usage: "show the capacity of the volumegroup per node",
+		Flags: []cli.Flag{
+			nodeFlag("Optional. only show the capacity of this node"),
+		},
+		Action: func(c *cli.Context) error {
+			t, err := newCtl(c)
+			if err != nil {
+				return err
+			}
+			nodes, err := t.nodes(c.Context, c)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NODE\tVG\tSIZE\tFREE\tUSED\tPVS\tLVS")
+			for _, report := range t.inspectAll(c.Context, nodes) {
+				switch {
+				case report.err != nil:
+					fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t%v\n", report.node, report.err)
+				case report.status.VG == nil:
+					fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\tno volumegroup %s\n", report.node, t.vgName)
+				default:
+					vg := report.status.VG
+					used := "-"
+					if vg.Size > 0 {
+						used = fmt.Sprintf("%d%%", 100*(vg.Size-vg.Free)/vg.Size)
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", report.node, vg.Name, formatBytes(vg.Size), formatBytes(vg.Free), used, vg.PVCount, vg.LVCount)
+				}
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func formatBytes(n uint64) string {
+	return resource.NewQuantity(int64(n), resource.BinarySI).String()
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// redundantSegtypes can be activated with missing legs without losing data
+var redundantSegtypes = []string{"raid1", "raid4", "raid5", "raid6", "raid10", "mirror"}
+
+// redundant is true if the logical volume can be activated with missing legs without losing data
+func redundant(lv *lvm.LV) bool {
+	for _, s := range redundantSegtypes {
+		if strings.HasPrefix(lv.SegType, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// activateLVs activates all logical volumes of the volumegroup.
+// If physical volumes are missing, every logical volume is activated on its own: complete ones as usual,
+// redundant ones with missing legs only in degraded mode if allowed, and non-redundant ones which lost extents are reported and skipped.
+func activateLVs(ctx context.Context, recorder *eventRecorder, vgName string, degradedActivation bool) {
+	missing := 0
+	vg, err := lvm.LookupVG(ctx, vgName)
+	if err != nil {
+		klog.Errorf("unable to determine missing pvs of vg %s err:%v", vgName, err)
+	} else {
+		missing = vg.MissingPVCount
+	}
+	if missing == 0 {
+		_, err := lvm.Run(ctx, "lvchange", "--activate", "y", vgName)
+		if err != nil {
+			klog.Infof("unable to activate logical volumes:%v", err)
+		}
+		return
+	}
+
+	recorder.nodeEvent(ctx, v1.EventTypeWarning, "PhysicalVolumesMissing", "%d physical volumes of volume group %s are missing, degraded activation is allowed:%t", missing, vgName, degradedActivation)
+
+	lvs, err := lvm.LVs(ctx, vgName)
+	if err != nil {
+		klog.Errorf("unable to list logical volumes of vg %s err:%v", vgName, err)
+		return
+	}
+	for _, lv := range lvs {
+		args := []string{"--activate", "y", "--activationmode", "complete", vgName + "/" + lv.Name}
+		switch {
+		case !lv.Partial():
+		case redundant(&lv) && degradedActivation:
+			args = []string{"--activate", "y", "--activationmode", "degraded", vgName + "/" + lv.Name}
+			recorder.volumeEvent(ctx, lv.Name, v1.EventTypeWarning, "DegradedActivation", "%s volume is activated with missing legs", lv.SegType)
+		case redundant(&lv):
+			recorder.volumeEvent(ctx, lv.Name, v1.EventTypeWarning, "ActivationSkipped", "%s volume has missing legs and degraded activation is not allowed", lv.SegType)
+			continue
+		default:
+			recorder.volumeEvent(ctx, lv.Name, v1.EventTypeWarning, "VolumeLostExtents", "%s volume lost extents on missing physical volumes and can not be activated", lv.SegType)
+			continue
+		}
+		klog.Infof("activate lv command: lvchange %s", args)
+		_, err := lvm.Run(ctx, "lvchange", args...)
+		if err != nil {
+			recorder.volumeEvent(ctx, lv.Name, v1.EventTypeWarning, "ActivationFailed", "unable to activate volume: %v", err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+const (
+	flagPVCNamespace = "pvc-namespace"
+	flagPVCName      = "pvc-name"
+)
+
+func adoptLVCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "adoptlv",
+		Usage: "adopt an existing logical volume of the volumegroup as persistent volume of a claim",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagLVName,
+				Usage: "Required. the name of the lv, it becomes the name of the persistent volume",
+			},
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+				Value: "csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:    flagDirectory,
+				Usage:   "Required. the name of the directory to mount the lv",
+				EnvVars: []string{envDirectory},
+				Value:   "/tmp/csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Required. the name of the node the persistent volume is bound to",
+				EnvVars: []string{envNodeName},
+			},
+			&cli.StringFlag{
+				Name:  flagPVCNamespace,
+				Usage: "Required. the namespace of the claim",
+			},
+			&cli.StringFlag{
+				Name:  flagPVCName,
+				Usage: "Required. the name of the claim, it must exist and must not be bound",
+			},
+			&cli.StringFlag{
+				Name:  flagFsckPolicy,
+				Usage: "Optional. check the filesystem before it is mounted again: never, preen or always",
+				Value: fsckPreen,
+			},
+			&cli.StringFlag{
+				Name:  flagProvisionerName,
+				Usage: "Optional. the provisioner of the persistent volume if the storageclass of the claim does not exist",
+				Value: "metal-stack.io/csi-lvm",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := adoptLV(c); err != nil {
+				klog.Fatalf("Error adopting lv: %v", err)
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+func adoptLV(c *cli.Context) error {
+	for _, flag := range []string{flagLVName, flagVGName, flagDirectory, flagNodeName, flagPVCNamespace, flagPVCName} {
+		if c.String(flag) == "" {
+			return fmt.Errorf("invalid empty flag %v", flag)
+		}
+	}
+	lvName := c.String(flagLVName)
+	vgName := c.String(flagVGName)
+	dirName := c.String(flagDirectory)
+	fsck := c.String(flagFsckPolicy)
+	if err := validFsckPolicy(fsck); err != nil {
+		return err
+	}
+	ctx := c.Context
+	recorder := newEventRecorder(c.String(flagNodeName))
+	if recorder.client == nil {
+		return fmt.Errorf("no access to the api server")
+	}
+
+	if errs := validation.IsDNS1123Subdomain(lvName); len(errs) > 0 {
+		return fmt.Errorf("lv name %s is no valid persistent volume name: %s", lvName, strings.Join(errs, ","))
+	}
+	_, err := recorder.client.CoreV1().PersistentVolumes().Get(ctx, lvName, metav1.GetOptions{})
+	if err == nil {
+		return fmt.Errorf("persistent volume %s already exists", lvName)
+	}
+	if !k8serror.IsNotFound(err) {
+		return err
+	}
+	pvc, err := recorder.client.CoreV1().PersistentVolumeClaims(c.String(flagPVCNamespace)).Get(ctx, c.String(flagPVCName), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get claim err:%w", err)
+	}
+	if pvc.Spec.VolumeName != "" {
+		return fmt.Errorf("claim %s/%s is already bound to %s", pvc.Namespace, pvc.Name, pvc.Spec.VolumeName)
+	}
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return fmt.Errorf("claim %s/%s has no storageclass", pvc.Namespace, pvc.Name)
+	}
+	blockMode := pvc.Spec.VolumeMode != nil && *pvc.Spec.VolumeMode == v1.PersistentVolumeBlock
+
+	lv, err := validateAdoption(ctx, vgName, lvName, blockMode)
+	if err != nil {
+		return err
+	}
+	capacity := resource.NewQuantity(int64(lv.Size), resource.BinarySI)
+	if request := pvc.Spec.Resources.Requests[v1.ResourceStorage]; capacity.Cmp(request) < 0 {
+		return fmt.Errorf("lv %s of %s is smaller than the request %s of the claim", lvName, capacity, request.String())
+	}
+
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	sc, err := recorder.client.StorageV1().StorageClasses().Get(ctx, *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if err == nil && sc.ReclaimPolicy != nil {
+		reclaimPolicy = *sc.ReclaimPolicy
+	}
+	volumeMode := v1.PersistentVolumeFilesystem
+	fsType := "ext4"
+	if blockMode {
+		volumeMode = v1.PersistentVolumeBlock
+		fsType = ""
+	}
+	metadata := volume.Metadata{
+		PVCNamespace:  pvc.Namespace,
+		PVCName:       pvc.Name,
+		PVCUID:        pvc.UID,
+		StorageClass:  *pvc.Spec.StorageClassName,
+		AccessModes:   pvc.Spec.AccessModes,
+		VolumeMode:    volumeMode,
+		ReclaimPolicy: reclaimPolicy,
+		FSType:        fsType,
+		Capacity:      *capacity,
+	}
+
+	tags := append([]string{lvTag, volume.SchemaTag(volume.SchemaVersion), "isBlock=" + strconv.FormatBool(blockMode)}, metadata.Tags()...)
+	if !blockMode {
+		tags = append(tags, fsckTagPrefix+fsck)
+	}
+	pv := preBoundPV(ctx, recorder, lvName, dirName, metadata, c.String(flagProvisionerName))
+	pv.Spec.ClaimRef.UID = pvc.UID
+
+	// a failed adoption is rolled back, otherwise the tagged volume could not be adopted again
+	tx := newTransaction(lvName)
+	err = adoptLVSteps(ctx, tx, recorder, vgName, lvName, dirName, blockMode, tags, pv)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	recorder.volumeEvent(ctx, lvName, v1.EventTypeNormal, "VolumeAdopted", "logical volume %s/%s adopted for claim %s/%s", vgName, lvName, pvc.Namespace, pvc.Name)
+	klog.Infof("lv %s vg:%s adopted for claim %s/%s", lvName, vgName, pvc.Namespace, pvc.Name)
+	return nil
+}
+
+// adoptLVSteps tags and mounts the logical volume and creates its persistent volume as steps of the transaction
+func adoptLVSteps(ctx context.Context, tx *transaction, recorder *eventRecorder, vgName, lvName, dirName string, blockMode bool, tags []string, pv *v1.PersistentVolume) error {
+	err := tx.step("tag lv", func() error {
+		err := lvm.AddTags(ctx, vgName, lvName, tags...)
+		if err != nil {
+			return fmt.Errorf("unable to add tags to lv:%s err:%w", lvName, err)
+		}
+		return nil
+	}, func() error {
+		return lvm.DeleteTags(ctx, vgName, lvName, tags...)
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.step("mount lv", func() error {
+		mount := func() (string, error) { return mountLV(lvName, vgName, dirName, false) }
+		if blockMode {
+			mount = func() (string, error) { return bindMountLV(lvName, vgName, dirName) }
+		}
+		output, err := mount()
+		if err != nil {
+			return fmt.Errorf("unable to mount lv: %w output:%s", err, output)
+		}
+		return nil
+	}, func() error {
+		return umountLV(lvName, vgName, dirName)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.step("create pv", func() error {
+		_, err := recorder.client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to create persistent volume %s err:%w", lvName, err)
+		}
+		return nil
+	}, nil)
+}
+
+// validateAdoption checks that the logical volume is not managed by csi-lvm yet, active, not in use and carries an ext4 filesystem unless it is used as block device
+func validateAdoption(ctx context.Context, vgName, lvName string, blockMode bool) (*lvm.LV, error) {
+	lv, err := lvm.LookupLV(ctx, vgName, lvName)
+	if err != nil {
+		return nil, fmt.Errorf("lv %s not found in vg %s: %w", lvName, vgName, err)
+	}
+	if lv.HasTag(lvTag) {
+		return nil, fmt.Errorf("lv %s is already managed by csi-lvm", lvName)
+	}
+	if !lv.Active || lv.Major < 0 || lv.Minor < 0 {
+		return nil, fmt.Errorf("lv %s is not active", lvName)
+	}
+	if lv.Open {
+		// e.g. mounted or used by another process
+		return nil, fmt.Errorf("lv %s is in use", lvName)
+	}
+	if blockMode {
+		return lv, nil
+	}
+	out, err := exec.Command("blkid", "--match-tag", "TYPE", "--output", "value", path.Join("/dev", vgName, lvName)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the filesystem of lv %s err:%w", lvName, err)
+	}
+	if fsType := strings.TrimSpace(string(out)); fsType != "ext4" {
+		return nil, fmt.Errorf("lv %s has a %q filesystem, only ext4 can be adopted as filesystem volume", lvName, fsType)
+	}
+	return lv, nil
+}
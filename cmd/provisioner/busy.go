@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"k8s.io/klog/v2"
+)
+
+// errBusy is returned if a volume is still in use, e.g. by a container of a pod which is stuck terminating
+var errBusy = errors.New("volume busy")
+
+// releaseLV unmounts the logical volume from its mountpoint, it fails with errBusy and leaves the volume mounted if the volume is still in use:
+// if it is mounted elsewhere in a mount namespace of the node, e.g. by the kubelet for a pod, if it is opened by anything else than its mount or if the mountpoint is busy.
+func releaseLV(ctx context.Context, lv *lvm.LV, dirName string) error {
+	mountPath := path.Join(dirName, lv.Name)
+	if lv.Major < 0 {
+		// an inactive volume can not be in use
+		return umountLV(lv.Name, lv.VGName, dirName)
+	}
+	majorMinor := fmt.Sprintf("%d:%d", lv.Major, lv.Minor)
+	users, err := foreignMounts("/proc", majorMinor, mountPath)
+	if err != nil {
+		return fmt.Errorf("unable to check the mounts of lv %s err:%w", lv.Name, err)
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("%w: lv %s is mounted at %s", errBusy, lv.Name, strings.Join(users, ","))
+	}
+
+	mountInfos, err := mounts()
+	if err != nil {
+		return err
+	}
+	m, mounted := mountInfos[mountPath]
+	// a mounted filesystem holds the volume open once, the bind mount of a block volume does not
+	expected := 0
+	if mounted && m.majorMinor == majorMinor {
+		expected = 1
+	}
+	count, err := openCount(lv)
+	if err != nil {
+		return err
+	}
+	if count > expected {
+		// e.g. block volumes are opened by the kubelet and by containers without a mount
+		return fmt.Errorf("%w: lv %s is opened %d times", errBusy, lv.Name, count-expected)
+	}
+
+	if mounted {
+		out, err := exec.Command("umount", mountPath).CombinedOutput()
+		if err != nil {
+			if strings.Contains(string(out), "busy") {
+				return fmt.Errorf("%w: %s", errBusy, strings.TrimSpace(string(out)))
+			}
+			return fmt.Errorf("unable to umount %s:%s err:%w", mountPath, strings.TrimSpace(string(out)), err)
+		}
+	}
+	count, err = openCount(lv)
+	if err == nil && count == 0 {
+		return nil
+	}
+	// opened in the meantime, the volume is mounted again
+	if mounted {
+		remount := func() (string, error) {
+			return mountLV(lv.Name, lv.VGName, dirName, slices.Contains(lv.Tags, quarantineTag))
+		}
+		if expected == 0 {
+			remount = func() (string, error) { return bindMountLV(lv.Name, lv.VGName, dirName) }
+		}
+		if output, e := remount(); e != nil {
+			klog.Errorf("unable to mount lv %s again output:%s err:%v", lv.Name, output, e)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: lv %s is opened %d times", errBusy, lv.Name, count)
+}
+
+// openCount returns how often the device of the logical volume is opened, e.g. by a mount or a process
+func openCount(lv *lvm.LV) (int, error) {
+	out, err := exec.Command("dmsetup", "info", "--columns", "--noheadings", "--options", "open", "--major", strconv.Itoa(lv.Major), "--minor", strconv.Itoa(lv.Minor)).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get open count of lv %s:%s err:%w", lv.Name, strings.TrimSpace(string(out)), err)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse open count of lv %s %q err:%w", lv.Name, strings.TrimSpace(string(out)), err)
+	}
+	return count, nil
+}
+
+// foreignMounts returns the mountpoints of the device in all mount namespaces of the node except its own mountpoint,
+// processes of other pods are only visible if the provisioner runs in the pid namespace of the node.
+func foreignMounts(procDir, majorMinor, mountPath string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(procDir, "[0-9]*", "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	seen := map[string]bool{}
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		ns, err := os.Readlink(filepath.Join(dir, "ns", "mnt"))
+		if err != nil || seen[ns] {
+			// the process is gone or its mount namespace was checked
+			continue
+		}
+		seen[ns] = true
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		mountInfos, err := parseMountInfo(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		for _, m := range mountInfos {
+			if m.majorMinor == majorMinor && m.mountPoint != mountPath {
+				result = append(result, fmt.Sprintf("%s (pid %s)", m.mountPoint, filepath.Base(dir)))
+			}
+		}
+	}
+	return result, nil
+}
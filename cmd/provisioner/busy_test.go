@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestForeignMounts(t *testing.T) {
+	procDir := t.TempDir()
+	node := "36 25 253:1 / /tmp/csi-lvm/pvc-1 rw,relatime shared:1 - ext4 /dev/mapper/csi--lvm-pvc--1 rw\n" +
+		"37 25 8:1 / / rw,relatime shared:2 - ext4 /dev/sda1 rw\n" +
+		"38 25 253:1 / /var/lib/kubelet/pods/abc/volumes/kubernetes.io~local-volume/pvc-1 rw,relatime shared:1 - ext4 /dev/mapper/csi--lvm-pvc--1 rw\n"
+	container := "40 39 253:1 / /data rw,relatime - ext4 /dev/mapper/csi--lvm-pvc--1 rw\n" +
+		"41 39 253:2 / /other rw,relatime - ext4 /dev/mapper/csi--lvm-pvc--2 rw\n"
+	processes := []struct {
+		pid       string
+		ns        string
+		mountInfo string
+	}{
+		{pid: "1", ns: "mnt:[4026531841]", mountInfo: node},
+		// the kubelet shares the mount namespace of the node, it is read once
+		{pid: "812", ns: "mnt:[4026531841]", mountInfo: node},
+		{pid: "4711", ns: "mnt:[4026532512]", mountInfo: container},
+		// a process without mount namespace is gone
+		{pid: "4712", mountInfo: container},
+	}
+	for _, p := range processes {
+		dir := filepath.Join(procDir, p.pid)
+		if err := os.MkdirAll(filepath.Join(dir, "ns"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "mountinfo"), []byte(p.mountInfo), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if p.ns != "" {
+			if err := os.Symlink(p.ns, filepath.Join(dir, "ns", "mnt")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name       string
+		majorMinor string
+		mountPath  string
+		want       []string
+	}{
+		{name: "own mountpoint only", majorMinor: "253:2", mountPath: "/other", want: nil},
+		{
+			name:       "mounted for a pod",
+			majorMinor: "253:1",
+			mountPath:  "/tmp/csi-lvm/pvc-1",
+			want:       []string{"/var/lib/kubelet/pods/abc/volumes/kubernetes.io~local-volume/pvc-1 (pid 1)", "/data (pid 4711)"},
+		},
+		{name: "not mounted", majorMinor: "253:3", mountPath: "/tmp/csi-lvm/pvc-3", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := foreignMounts(procDir, tt.majorMinor, tt.mountPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("foreignMounts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
-	"github.com/google/lvmd/commands"
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/volume"
 	"github.com/urfave/cli/v2"
 	"k8s.io/klog/v2"
 )
@@ -24,7 +26,7 @@ const (
 func createLVCmd() *cli.Command {
 	return &cli.Command{
 		Name: "createlv",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:  flagLVName,
 				Usage: "Required. Specify lv name.",
@@ -45,17 +47,36 @@ func createLVCmd() *cli.Command {
 				Name:  flagLVMType,
 				Usage: "Required. type of lvs, can be either striped or mirrored",
 			},
-			&cli.StringSliceFlag{
-				Name:  flagDevicesPattern,
-				Usage: "Required. the patterns of the physical volumes to use.",
-			},
 			&cli.BoolFlag{
 				Name:  flagBlockMode,
 				Usage: "Optional. create a block device only, default false",
 			},
-		},
+			&cli.StringFlag{
+				Name:  flagFsckPolicy,
+				Usage: "Optional. check the filesystem before it is mounted again: never, preen or always",
+				Value: fsckPreen,
+			},
+			&cli.StringFlag{
+				Name:  flagFSLabel,
+				Usage: "Optional. the label of the filesystem, truncated to 16 characters",
+			},
+			&cli.StringSliceFlag{
+				Name:  flagTag,
+				Usage: "Optional. additional tags of the lv which describe its persistent volume",
+			},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Optional. the name of the node to emit events for",
+				EnvVars: []string{envNodeName},
+			},
+			&cli.BoolFlag{
+				Name:  flagKeepOnFailure,
+				Usage: "Optional. keep the logical volume and its mount of a failed createlv for inspection instead of rolling them back",
+			},
+		}, deviceSelectorFlags()...),
 		Action: func(c *cli.Context) error {
 			if err := createLV(c); err != nil {
+				terminate(err)
 				klog.Fatalf("Error creating lv: %v", err)
 				return err
 			}
@@ -67,78 +88,137 @@ func createLVCmd() *cli.Command {
 func createLV(c *cli.Context) error {
 	lvName := c.String(flagLVName)
 	if lvName == "" {
-		return fmt.Errorf("invalid empty flag %v", flagLVName)
+		return invalidArgument(fmt.Errorf("invalid empty flag %v", flagLVName))
 	}
 	lvSize := c.Uint64(flagLVSize)
 	if lvSize == 0 {
-		return fmt.Errorf("invalid empty flag %v", flagLVSize)
+		return invalidArgument(fmt.Errorf("invalid empty flag %v", flagLVSize))
 	}
 	vgName := c.String(flagVGName)
 	if vgName == "" {
-		return fmt.Errorf("invalid empty flag %v", flagVGName)
+		return invalidArgument(fmt.Errorf("invalid empty flag %v", flagVGName))
 	}
 	dirName := c.String(flagDirectory)
 	if dirName == "" {
-		return fmt.Errorf("invalid empty flag %v", flagDirectory)
+		return invalidArgument(fmt.Errorf("invalid empty flag %v", flagDirectory))
 	}
-	devicesPattern := c.StringSlice(flagDevicesPattern)
-	if len(devicesPattern) == 0 {
-		return fmt.Errorf("invalid empty flag %v", flagDevicesPattern)
+	selector, err := deviceSelectorFromContext(c)
+	if err != nil {
+		return invalidArgument(err)
 	}
 	lvmType := c.String(flagLVMType)
 	if lvmType == "" {
-		return fmt.Errorf("invalid empty flag %v", flagLVMType)
+		return invalidArgument(fmt.Errorf("invalid empty flag %v", flagLVMType))
 	}
 	blockMode := c.Bool(flagBlockMode)
+	fsck := c.String(flagFsckPolicy)
+	if err := validFsckPolicy(fsck); err != nil {
+		return invalidArgument(err)
+	}
+	tags := c.StringSlice(flagTag)
+	if !blockMode {
+		tags = append(tags, fsckTagPrefix+fsck)
+		if !slices.Contains(tags, volume.FSTypeTag("ext4")) {
+			tags = append(tags, volume.FSTypeTag("ext4"))
+		}
+	}
 
-	klog.Infof("create lv %s size:%d vg:%s devicespattern:%s dir:%s type:%s block:%t", lvName, lvSize, vgName, devicesPattern, dirName, lvmType, blockMode)
+	klog.Infof("create lv %s size:%d vg:%s devices:%s dir:%s type:%s block:%t", lvName, lvSize, vgName, selector, dirName, lvmType, blockMode)
 
-	output, err := createVG(vgName, devicesPattern)
+	ctx := context.Background()
+	recorder := newEventRecorder(c.String(flagNodeName))
+
+	tx := newTransaction(lvName)
+	err = createLVSteps(ctx, tx, recorder, vgName, lvName, dirName, lvSize, lvmType, blockMode, c.String(flagFSLabel), selector, tags)
 	if err != nil {
-		return fmt.Errorf("unable to create vg: %w output:%s", err, output)
+		if c.Bool(flagKeepOnFailure) {
+			tx.keep()
+		} else {
+			tx.rollback()
+		}
+		return err
 	}
+	klog.Infof("lv %s size:%d vg:%s devices:%s block:%t created", lvName, lvSize, vgName, selector, blockMode)
+	return nil
+}
 
-	output, err = createLVS(context.Background(), vgName, lvName, lvSize, lvmType, blockMode)
+// createLVSteps creates the volumegroup if required, the logical volume and its mount as steps of the transaction,
+// the volumegroup is never rolled back because it is shared by all volumes
+func createLVSteps(ctx context.Context, tx *transaction, recorder *eventRecorder, vgName, lvName, dirName string, lvSize uint64, lvmType string, blockMode bool, label string, selector *deviceSelector, tags []string) error {
+	err := tx.step("create vg "+vgName, func() error {
+		output, err := createVG(ctx, recorder, vgName, selector)
+		if err != nil {
+			return fmt.Errorf("unable to create vg: %w output:%s", err, output)
+		}
+		return nil
+	}, nil)
 	if err != nil {
-		return fmt.Errorf("unable to create lv: %w output:%s", err, output)
+		return err
 	}
 
-	if !blockMode {
-		output, err = mountLV(lvName, vgName, dirName)
+	created := false
+	err = tx.step("create lv", func() error {
+		output, c, err := createLVS(ctx, vgName, lvName, lvSize, lvmType, blockMode, tags...)
 		if err != nil {
-			return fmt.Errorf("unable to mount lv: %w output:%s", err, output)
+			return fmt.Errorf("unable to create lv: %w output:%s", err, output)
 		}
-		klog.Infof("mounted lv %s size:%d vg:%s devices:%s created", lvName, lvSize, vgName, devicesPattern)
-	} else {
-		output, err = bindMountLV(lvName, vgName, dirName)
-		if err != nil {
-			return fmt.Errorf("unable to bind mount lv: %w output:%s", err, output)
+		created = c
+		return nil
+	}, func() error {
+		// an existing volume of a previous attempt is kept
+		if !created {
+			return nil
+		}
+		err := lvm.RemoveLV(ctx, vgName, lvName)
+		if errors.Is(err, lvm.ErrNotFound) {
+			return nil
 		}
-		klog.Infof("block lv %s size:%d vg:%s devices:%s created", lvName, lvSize, vgName, devicesPattern)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	if blockMode {
+		return tx.step("bind mount lv", func() error {
+			output, err := bindMountLV(lvName, vgName, dirName)
+			if err != nil {
+				return fmt.Errorf("unable to bind mount lv: %w output:%s", err, output)
+			}
+			return nil
+		}, func() error {
+			return umountLV(lvName, vgName, dirName)
+		})
+	}
 
-func devices(devicesPattern []string) (devices []string, err error) {
-	for _, devicePattern := range devicesPattern {
-		klog.Infof("search devices :%s ", devicePattern)
-		matches, err := filepath.Glob(devicePattern)
+	// the filesystem is removed with the volume
+	err = tx.step("format lv", func() error {
+		output, err := formatLV(lvName, vgName, fsLabel(label))
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("unable to format lv: %w output:%s", err, output)
 		}
-		klog.Infof("found: %s", matches)
-		devices = append(devices, matches...)
+		return nil
+	}, nil)
+	if err != nil {
+		return err
 	}
-	return devices, nil
+	return tx.step("mount lv", func() error {
+		output, err := mountLV(lvName, vgName, dirName, false)
+		if err != nil {
+			return fmt.Errorf("unable to mount lv: %w output:%s", err, output)
+		}
+		return nil
+	}, func() error {
+		return umountLV(lvName, vgName, dirName)
+	})
 }
 
-func mountLV(lvname, vgname, directory string) (string, error) {
+// formatLV creates an ext4 filesystem with the given label, if empty without, on the logical volume unless it is already formatted
+func formatLV(lvname, vgname, label string) (string, error) {
 	// check for format with blkid /dev/csi-lvm/pvc-xxxxx
 	// /dev/dm-3: UUID="d1910e3a-32a9-48d2-aa2e-e5ad018237c9" TYPE="ext4"
 	lvPath := fmt.Sprintf("/dev/%s/%s", vgname, lvname)
 
-	formatted := false
 	// check for already formatted
 	cmd := exec.Command("blkid", lvPath)
 	out, err := cmd.CombinedOutput()
@@ -146,47 +226,70 @@ func mountLV(lvname, vgname, directory string) (string, error) {
 		klog.Infof("unable to check if %s is already formatted:%v", lvPath, err)
 	}
 	if strings.Contains(string(out), "ext4") {
-		formatted = true
+		return string(out), nil
 	}
 
-	mountPath := path.Join(directory, lvname)
-	if !formatted {
-		klog.Infof("formatting with mkfs.ext4 %s", lvPath)
-		cmd = exec.Command("mkfs.ext4", lvPath)
-		out, err = cmd.CombinedOutput()
-		if err != nil {
-			return string(out), fmt.Errorf("unable to format lv:%s err:%w", lvname, err)
-		}
+	args := []string{lvPath}
+	if label != "" {
+		args = append([]string{"-L", label}, args...)
 	}
+	klog.Infof("formatting with mkfs.ext4 %s", args)
+	cmd = exec.Command("mkfs.ext4", args...)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("unable to format lv:%s err:%w", lvname, err)
+	}
+	return string(out), nil
+}
 
-	err = os.MkdirAll(mountPath, 0777)
+// fsLabel truncates the label to the maximum length of ext4 labels
+func fsLabel(label string) string {
+	const maxLength = 16
+	if len(label) > maxLength {
+		return label[:maxLength]
+	}
+	return label
+}
+
+// mountLV mounts the ext4 filesystem of the logical volume, it never formats the volume.
+// Only createlv formats new volumes, an existing volume without filesystem fails to mount.
+func mountLV(lvname, vgname, directory string, readOnly bool) (string, error) {
+	lvPath := fmt.Sprintf("/dev/%s/%s", vgname, lvname)
+	mountPath := path.Join(directory, lvname)
+
+	err := prepareMountpoint(mountPath, false)
 	if err != nil {
-		return string(out), fmt.Errorf("unable to create mount directory for lv:%s err:%w", lvname, err)
+		return "", fmt.Errorf("unable to create mount directory for lv:%s err:%w", lvname, err)
 	}
 
 	// --make-shared is required that this mount is visible outside this container.
 	mountArgs := []string{"--make-shared", "--type", "ext4", lvPath, mountPath}
+	if readOnly {
+		mountArgs = append([]string{"--options", "ro"}, mountArgs...)
+	}
 	klog.Infof("mountlv command: mount %s", mountArgs)
-	cmd = exec.Command("mount", mountArgs...)
-	out, err = cmd.CombinedOutput()
+	cmd := exec.Command("mount", mountArgs...)
+	mountOut, err := cmd.CombinedOutput()
 	if err != nil {
-		mountOutput := string(out)
+		mountOutput := string(mountOut)
 		if !strings.Contains(mountOutput, "already mounted") {
-			return string(out), fmt.Errorf("unable to mount %s to %s err:%w output:%s", lvPath, mountPath, err, out)
+			return string(mountOut), fmt.Errorf("unable to mount %s to %s err:%w output:%s", lvPath, mountPath, err, mountOut)
 		}
 	}
-	err = os.Chmod(mountPath, 0777)
-	if err != nil {
-		return "", fmt.Errorf("unable to change permissions of volume mount %s err:%w", mountPath, err)
+	if !readOnly {
+		err = os.Chmod(mountPath, 0777)
+		if err != nil {
+			return "", fmt.Errorf("unable to change permissions of volume mount %s err:%w", mountPath, err)
+		}
 	}
-	klog.Infof("mountlv output:%s", out)
+	klog.Infof("mountlv output:%s", mountOut)
 	return "", nil
 }
 
 func bindMountLV(lvname, vgname, directory string) (string, error) {
 	lvPath := fmt.Sprintf("/dev/%s/%s", vgname, lvname)
 	mountPath := path.Join(directory, lvname)
-	_, err := os.Create(mountPath)
+	err := prepareMountpoint(mountPath, true)
 	if err != nil {
 		return "", fmt.Errorf("unable to create mount directory for lv:%s err:%w", lvname, err)
 	}
@@ -212,36 +315,26 @@ func bindMountLV(lvname, vgname, directory string) (string, error) {
 }
 
 func vgExists(name string) bool {
-	vgs, err := commands.ListVG(context.Background())
-	if err != nil {
+	_, err := lvm.LookupVG(context.Background(), name)
+	if err != nil && !errors.Is(err, lvm.ErrNotFound) {
 		klog.Infof("unable to list existing volumegroups:%v", err)
 	}
-	vgexists := false
-	for _, vg := range vgs {
-		klog.Infof("compare vg:%s with:%s\n", vg.Name, name)
-		if vg.Name == name {
-			vgexists = true
-			break
-		}
-	}
-	return vgexists
+	return err == nil
 }
 
 func vgactivate() {
 	// scan for vgs and activate if any
-	cmd := exec.Command("vgscan")
-	out, err := cmd.CombinedOutput()
+	_, err := lvm.Run(context.Background(), "vgscan")
 	if err != nil {
-		klog.Infof("unable to scan for volumegroups:%s %v", out, err)
+		klog.Infof("unable to scan for volumegroups:%v", err)
 	}
-	cmd = exec.Command("vgchange", "--activate","y")
-	_, err = cmd.CombinedOutput()
+	_, err = lvm.Run(context.Background(), "vgchange", "--activate", "y")
 	if err != nil {
-		klog.Infof("unable to activate volumegroups:%s %v", out, err)
+		klog.Infof("unable to activate volumegroups:%v", err)
 	}
 }
 
-func createVG(name string, devicesPattern []string) (string, error) {
+func createVG(ctx context.Context, recorder *eventRecorder, name string, selector *deviceSelector) (string, error) {
 	vgexists := vgExists(name)
 	if vgexists {
 		klog.Infof("volumegroup: %s already exists\n", name)
@@ -255,9 +348,21 @@ func createVG(name string, devicesPattern []string) (string, error) {
 		return name, nil
 	}
 
-	physicalVolumes, err := devices(devicesPattern)
+	candidates, err := devices(selector)
 	if err != nil {
-		return "", fmt.Errorf("unable to lookup devices from devicesPattern %s, err:%w", devicesPattern, err)
+		return "", fmt.Errorf("unable to lookup devices from %s, err:%w", selector, err)
+	}
+	checks, err := preflight(ctx, recorder, name, candidates)
+	if err != nil {
+		return "", fmt.Errorf("unable to check devices, err:%w", err)
+	}
+	reportPreflight(ctx, recorder, name, checks)
+	physicalVolumes, err := prepareDevices(checks)
+	if err != nil {
+		return "", err
+	}
+	if len(physicalVolumes) == 0 {
+		return "", fmt.Errorf("no usable devices found for %s %w", selector, lvm.ErrInsufficientSpace)
 	}
 	tags := []string{"vg.metal-stack.io/csi-lvm"}
 
@@ -267,40 +372,38 @@ func createVG(name string, devicesPattern []string) (string, error) {
 		args = append(args, "--addtag", tag)
 	}
 	klog.Infof("create vg with command: vgcreate %v", args)
-	cmd := exec.Command("vgcreate", args...)
-	out, err := cmd.CombinedOutput()
-	return string(out), err
+	return lvm.Run(ctx, "vgcreate", args...)
 }
 
-// createLV creates a new volume
-func createLVS(ctx context.Context, vg string, name string, size uint64, lvmType string, blockMode bool) (string, error) {
-	lvs, err := commands.ListLV(ctx, vg+"/"+name)
-	if err != nil {
-		klog.Infof("unable to list existing logicalvolumes:%v", err)
-	}
-	lvExists := false
-	for _, lv := range lvs {
-		klog.Infof("compare lv:%s with:%s\n", lv.Name, name)
-		if strings.Contains(lv.Name, name) {
-			lvExists = true
-			break
-		}
+// createLVS creates a new volume, an existing volume of the same name is verified against the request and extended if it is smaller.
+// created is false if the volume existed.
+func createLVS(ctx context.Context, vg string, name string, size uint64, lvmType string, blockMode bool, extraTags ...string) (output string, created bool, err error) {
+	if size == 0 {
+		return "", false, invalidArgument(fmt.Errorf("size must be greater than 0"))
 	}
 
-	if lvExists {
-		klog.Infof("logicalvolume: %s already exists\n", name)
-		return name, nil
+	v, err := lvm.LookupVG(ctx, vg)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to determine pv count of vg: %w", err)
 	}
+	pvs := v.PVCount
 
-	if size == 0 {
-		return "", fmt.Errorf("size must be greater than 0")
+	lv, err := lvm.LookupLV(ctx, vg, name)
+	if err == nil {
+		klog.Infof("logicalvolume: %s already exists\n", name)
+		// a volume of the requested type is reused even if the vg lost physical volumes since, linear only if it was the fallback
+		accepted := []string{lvmType}
+		if pvs < 2 {
+			accepted = append(accepted, linearType)
+		}
+		err = verifyLV(ctx, lv, size, accepted, blockMode, extraTags)
+		if err != nil {
+			return "", false, err
+		}
+		return name, false, nil
 	}
-
-	args := []string{"--verbose", "--name", name, "--wipesignatures", "y", "--yes", "--size", fmt.Sprintf("%db", size)}
-
-	pvs, err := pvCount(vg)
-	if err != nil {
-		return "", fmt.Errorf("unable to determine pv count of vg: %w", err)
+	if !errors.Is(err, lvm.ErrNotFound) {
+		return "", false, fmt.Errorf("unable to lookup existing logicalvolume err:%w", err)
 	}
 
 	if pvs < 2 {
@@ -308,6 +411,8 @@ func createLVS(ctx context.Context, vg string, name string, size uint64, lvmType
 		lvmType = linearType
 	}
 
+	args := []string{"--verbose", "--name", name, "--wipesignatures", "y", "--yes", "--size", fmt.Sprintf("%db", size)}
+
 	switch lvmType {
 	case stripedType:
 		args = append(args, "--type", "striped", "--stripes", fmt.Sprintf("%d", pvs))
@@ -315,30 +420,68 @@ func createLVS(ctx context.Context, vg string, name string, size uint64, lvmType
 		args = append(args, "--type", "raid1", "--mirrors", "1", "--nosync")
 	case linearType:
 	default:
-		return "", fmt.Errorf("unsupported lvmtype: %s", lvmType)
+		return "", false, invalidArgument(fmt.Errorf("unsupported lvmtype: %s", lvmType))
 	}
 
-	tags := []string{"lv.metal-stack.io/csi-lvm", "isBlock=" + strconv.FormatBool(blockMode)}
+	tags := append([]string{lvTag, volume.SchemaTag(volume.SchemaVersion), "isBlock=" + strconv.FormatBool(blockMode)}, extraTags...)
 	for _, tag := range tags {
 		args = append(args, "--addtag", tag)
 	}
 	args = append(args, vg)
 	klog.Infof("lvreate %s", args)
-	cmd := exec.Command("lvcreate", args...)
-	out, err := cmd.CombinedOutput()
-	return string(out), err
+	output, err = lvm.Run(ctx, "lvcreate", args...)
+	return output, err == nil, err
 }
 
-func pvCount(vgname string) (int, error) {
-	cmd := exec.Command("vgs", vgname, "--noheadings", "--options", "pv_count")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return 0, err
+// segTypes are the segment types lvcreate creates for the lvm types
+var segTypes = map[string]string{
+	linearType:  "linear",
+	stripedType: "striped",
+	mirrorType:  "raid1",
+}
+
+// verifyLV checks that an existing logical volume was created for the same claim with one of the accepted types and the same mode,
+// a retried createlv must never hand out a volume of another claim or shape. A smaller volume is extended.
+func verifyLV(ctx context.Context, lv *lvm.LV, size uint64, lvmTypes []string, blockMode bool, extraTags []string) error {
+	if !lv.HasTag(lvTag) {
+		return fmt.Errorf("%w: lv %s was not created by csi-lvm", errConflict, lv.Name)
+	}
+	if uid := volume.ClaimUID(extraTags); uid != "" && volume.ClaimUID(lv.Tags) != uid {
+		return fmt.Errorf("%w: lv %s belongs to claim %q with uid %q instead of uid %q", errConflict, lv.Name, volume.Owner(lv.Tags), volume.ClaimUID(lv.Tags), uid)
+	}
+	if isBlockLV(lv) != blockMode {
+		return fmt.Errorf("%w: lv %s has block mode %t instead of %t", errConflict, lv.Name, isBlockLV(lv), blockMode)
+	}
+	var accepted []string
+	for _, lvmType := range lvmTypes {
+		segType, ok := segTypes[lvmType]
+		if !ok {
+			return invalidArgument(fmt.Errorf("unsupported lvmtype: %s", lvmType))
+		}
+		accepted = append(accepted, segType)
+	}
+	if !slices.Contains(accepted, lv.SegType) {
+		return fmt.Errorf("%w: lv %s has type %s instead of %s", errConflict, lv.Name, lv.SegType, strings.Join(accepted, " or "))
 	}
-	outStr := strings.TrimSpace(string(out))
-	count, err := strconv.Atoi(outStr)
+	if lv.Size >= size {
+		return nil
+	}
+
+	args := []string{"--size", fmt.Sprintf("%db", size)}
+	if !blockMode && hasFilesystem(lv.VGName, lv.Name) {
+		args = append(args, "--resizefs")
+	}
+	args = append(args, lv.VGName+"/"+lv.Name)
+	klog.Infof("lv %s has %d bytes instead of %d, extend with command: lvextend %s", lv.Name, lv.Size, size, args)
+	_, err := lvm.Run(ctx, "lvextend", args...)
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("unable to extend lv %s err:%w", lv.Name, err)
 	}
-	return count, nil
+	return nil
+}
+
+// hasFilesystem returns true if the logical volume is formatted
+func hasFilesystem(vgname, lvname string) bool {
+	out, err := exec.Command("blkid", "--match-tag", "TYPE", "--output", "value", fmt.Sprintf("/dev/%s/%s", vgname, lvname)).Output()
+	return err == nil && strings.TrimSpace(string(out)) != ""
 }
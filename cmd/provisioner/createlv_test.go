@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+)
+
+func TestVerifyLV(t *testing.T) {
+	claim := []string{"pvc.uid=1234"}
+	lv := func(segType string, tags ...string) *lvm.LV {
+		return &lvm.LV{Name: "pvc-1", VGName: "csi-lvm", Size: 1 << 30, SegType: segType, Tags: append([]string{lvTag, "isBlock=false", "pvc.uid=1234"}, tags...)}
+	}
+	tests := []struct {
+		name      string
+		lv        *lvm.LV
+		lvmTypes  []string
+		blockMode bool
+		extraTags []string
+		conflict  bool
+		invalid   bool
+	}{
+		{name: "same volume", lv: lv("linear"), lvmTypes: []string{linearType}, extraTags: claim},
+		{name: "without claim uid", lv: lv("linear"), lvmTypes: []string{linearType}},
+		{name: "mirror", lv: lv("raid1"), lvmTypes: []string{mirrorType}, extraTags: claim},
+		{name: "linear fallback of a mirror", lv: lv("linear"), lvmTypes: []string{mirrorType, linearType}, extraTags: claim},
+		{
+			name:     "not created by csi-lvm",
+			lv:       &lvm.LV{Name: "pvc-1", VGName: "csi-lvm", Size: 1 << 30, SegType: "linear"},
+			lvmTypes: []string{linearType},
+			conflict: true,
+		},
+		{
+			name:      "other claim",
+			lv:        &lvm.LV{Name: "pvc-1", VGName: "csi-lvm", Size: 1 << 30, SegType: "linear", Tags: []string{lvTag, "isBlock=false", "pvc.uid=5678"}},
+			lvmTypes:  []string{linearType},
+			extraTags: claim,
+			conflict:  true,
+		},
+		{name: "other mode", lv: lv("linear"), lvmTypes: []string{linearType}, blockMode: true, extraTags: claim, conflict: true},
+		{name: "linear instead of mirror", lv: lv("linear"), lvmTypes: []string{mirrorType}, extraTags: claim, conflict: true},
+		{name: "striped instead of linear", lv: lv("striped"), lvmTypes: []string{linearType}, extraTags: claim, conflict: true},
+		{name: "unsupported type", lv: lv("linear"), lvmTypes: []string{"raid5"}, extraTags: claim, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the size matches, lvextend is never run
+			err := verifyLV(context.Background(), tt.lv, 1<<30, tt.lvmTypes, tt.blockMode, tt.extraTags)
+			var invalid invalidArgumentError
+			switch {
+			case tt.conflict:
+				if !errors.Is(err, errConflict) {
+					t.Errorf("verifyLV() error = %v, want conflict", err)
+				}
+			case tt.invalid:
+				if !errors.As(err, &invalid) {
+					t.Errorf("verifyLV() error = %v, want invalid argument", err)
+				}
+			case err != nil:
+				t.Errorf("verifyLV() error = %v", err)
+			}
+		})
+	}
+}
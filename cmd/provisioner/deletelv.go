@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 
-	"github.com/google/lvmd/commands"
+	"github.com/metal-stack/csi-lvm/internal/lvm"
 	"github.com/urfave/cli/v2"
 	"k8s.io/klog/v2"
 )
@@ -35,6 +37,7 @@ func deleteLVCmd() *cli.Command {
 		},
 		Action: func(c *cli.Context) error {
 			if err := deleteLV(c); err != nil {
+				terminate(err)
 				klog.Fatalf("Error deleting lv: %v", err)
 				return err
 			}
@@ -46,42 +49,68 @@ func deleteLVCmd() *cli.Command {
 func deleteLV(c *cli.Context) error {
 	lvName := c.String(flagLVName)
 	if lvName == "" {
-		return fmt.Errorf("invalid empty flag %v", flagLVName)
+		return invalidArgument(fmt.Errorf("invalid empty flag %v", flagLVName))
 	}
 	vgName := c.String(flagVGName)
 	if vgName == "" {
-		return fmt.Errorf("invalid empty flag %v", flagVGName)
+		return invalidArgument(fmt.Errorf("invalid empty flag %v", flagVGName))
 	}
 	dirName := c.String(flagDirectory)
 	if dirName == "" {
-		return fmt.Errorf("invalid empty flag %v", flagDirectory)
+		return invalidArgument(fmt.Errorf("invalid empty flag %v", flagDirectory))
 	}
 	blockMode := c.Bool(flagBlockMode)
 
 	klog.Infof("delete lv %s vg:%s dir:%s block:%t", lvName, vgName, dirName, blockMode)
 
-	umountLV(lvName, vgName, dirName)
+	ctx := context.Background()
+	lv, err := lvm.LookupLV(ctx, vgName, lvName)
+	if errors.Is(err, lvm.ErrNotFound) {
+		klog.Infof("lv %s vg:%s does not exist, nothing to delete", lvName, vgName)
+		return umountLV(lvName, vgName, dirName)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to lookup lv err:%w", err)
+	}
+	err = releaseLV(ctx, lv, dirName)
+	if err != nil {
+		return err
+	}
+	err = umountLV(lvName, vgName, dirName)
+	if err != nil {
+		return err
+	}
 
-	output, err := commands.RemoveLV(context.Background(), vgName, lvName)
+	err = lvm.RemoveLV(ctx, vgName, lvName)
 	if err != nil {
-		return fmt.Errorf("unable to delete lv: %w output:%s", err, output)
+		return fmt.Errorf("unable to delete lv: %w", err)
 	}
 	klog.Infof("lv %s vg:%s deleted", lvName, vgName)
 	return nil
 }
 
-func umountLV(lvname, vgname, directory string) string {
+// umountLV unmounts the logical volume without force and removes its mountpoint
+func umountLV(lvname, vgname, directory string) error {
 	lvPath := fmt.Sprintf("/dev/%s/%s", vgname, lvname)
 	mountPath := path.Join(directory, lvname)
 
-	cmd := exec.Command("umount", "--lazy", "--force", mountPath)
-	out, err := cmd.CombinedOutput()
+	mounted, err := isMountpoint(mountPath)
 	if err != nil {
-		klog.Errorf("unable to umount %s from %s output:%s err:%v", mountPath, lvPath, string(out), err)
+		return err
+	}
+	if mounted {
+		out, err := exec.Command("umount", mountPath).CombinedOutput()
+		if err != nil {
+			if strings.Contains(string(out), "busy") {
+				return fmt.Errorf("%w: %s", errBusy, strings.TrimSpace(string(out)))
+			}
+			return fmt.Errorf("unable to umount %s from %s:%s err:%w", mountPath, lvPath, strings.TrimSpace(string(out)), err)
+		}
 	}
+	unprotectMountpoint(mountPath)
 	err = os.Remove(mountPath)
-	if err != nil {
-		klog.Errorf("unable to remove mount directory:%s err:%v", mountPath, err)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove mount directory:%s err:%w", mountPath, err)
 	}
-	return ""
+	return nil
 }
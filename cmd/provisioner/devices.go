@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+// blockDevice is a single entry of the lsblk json output
+type blockDevice struct {
+	Name        string        `json:"name"`
+	Path        string        `json:"path"`
+	MajMin      string        `json:"maj:min"`
+	Size        uint64        `json:"size"`
+	Rotational  bool          `json:"rota"`
+	Transport   string        `json:"tran"`
+	Model       string        `json:"model"`
+	Serial      string        `json:"serial"`
+	Type        string        `json:"type"`
+	FSType      string        `json:"fstype"`
+	PTType      string        `json:"pttype"`
+	Mountpoints []string      `json:"mountpoints"`
+	Children    []blockDevice `json:"children"`
+}
+
+type lsblkOutput struct {
+	BlockDevices []blockDevice `json:"blockdevices"`
+}
+
+// deviceSelector describes which block devices of a node should become physical volumes.
+// Devices are first matched by the glob patterns and then filtered by the optional properties.
+type deviceSelector struct {
+	patterns   []string
+	model      *regexp.Regexp
+	serial     *regexp.Regexp
+	rotational *bool
+	minSize    uint64
+	maxSize    uint64
+	transports []string
+}
+
+func deviceSelectorFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    flagDevicesPattern,
+			Usage:   "Required. the patterns of the physical volumes to use, /dev/disk/by-id links are resolved.",
+			EnvVars: []string{envDevicesPattern},
+		},
+		&cli.StringFlag{
+			Name:    flagDeviceModel,
+			Usage:   "Optional. regular expression the device model must match",
+			EnvVars: []string{envDeviceModel},
+		},
+		&cli.StringFlag{
+			Name:    flagDeviceSerial,
+			Usage:   "Optional. regular expression the device serial must match",
+			EnvVars: []string{envDeviceSerial},
+		},
+		&cli.StringFlag{
+			Name:    flagDeviceRotational,
+			Usage:   "Optional. select only rotational (true) or non-rotational (false) devices",
+			EnvVars: []string{envDeviceRotational},
+		},
+		&cli.StringFlag{
+			Name:    flagDeviceMinSize,
+			Usage:   "Optional. minimum size of a device, e.g. 100Gi",
+			EnvVars: []string{envDeviceMinSize},
+		},
+		&cli.StringFlag{
+			Name:    flagDeviceMaxSize,
+			Usage:   "Optional. maximum size of a device, e.g. 4Ti",
+			EnvVars: []string{envDeviceMaxSize},
+		},
+		&cli.StringSliceFlag{
+			Name:    flagDeviceTransport,
+			Usage:   "Optional. transports a device must use, e.g. nvme,sata",
+			EnvVars: []string{envDeviceTransport},
+		},
+	}
+}
+
+func deviceSelectorFromContext(c *cli.Context) (*deviceSelector, error) {
+	s := &deviceSelector{
+		patterns:   c.StringSlice(flagDevicesPattern),
+		transports: c.StringSlice(flagDeviceTransport),
+	}
+	if len(s.patterns) == 0 {
+		return nil, fmt.Errorf("invalid empty flag %v", flagDevicesPattern)
+	}
+	var err error
+	if model := c.String(flagDeviceModel); model != "" {
+		s.model, err = regexp.Compile(model)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flag %v: %w", flagDeviceModel, err)
+		}
+	}
+	if serial := c.String(flagDeviceSerial); serial != "" {
+		s.serial, err = regexp.Compile(serial)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flag %v: %w", flagDeviceSerial, err)
+		}
+	}
+	if rotational := c.String(flagDeviceRotational); rotational != "" {
+		r, err := strconv.ParseBool(rotational)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flag %v: %w", flagDeviceRotational, err)
+		}
+		s.rotational = &r
+	}
+	s.minSize, err = parseDeviceSize(c.String(flagDeviceMinSize))
+	if err != nil {
+		return nil, fmt.Errorf("invalid flag %v: %w", flagDeviceMinSize, err)
+	}
+	s.maxSize, err = parseDeviceSize(c.String(flagDeviceMaxSize))
+	if err != nil {
+		return nil, fmt.Errorf("invalid flag %v: %w", flagDeviceMaxSize, err)
+	}
+	return s, nil
+}
+
+func parseDeviceSize(size string) (uint64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(q.Value()), nil
+}
+
+func (s *deviceSelector) String() string {
+	parts := []string{fmt.Sprintf("patterns:%s", s.patterns)}
+	if s.model != nil {
+		parts = append(parts, fmt.Sprintf("model:%s", s.model))
+	}
+	if s.serial != nil {
+		parts = append(parts, fmt.Sprintf("serial:%s", s.serial))
+	}
+	if s.rotational != nil {
+		parts = append(parts, fmt.Sprintf("rotational:%t", *s.rotational))
+	}
+	if s.minSize > 0 {
+		parts = append(parts, fmt.Sprintf("minsize:%d", s.minSize))
+	}
+	if s.maxSize > 0 {
+		parts = append(parts, fmt.Sprintf("maxsize:%d", s.maxSize))
+	}
+	if len(s.transports) > 0 {
+		parts = append(parts, fmt.Sprintf("transports:%s", s.transports))
+	}
+	return strings.Join(parts, " ")
+}
+
+// matches returns an empty string if the device matches all properties of the selector,
+// otherwise the reason why it does not match.
+func (s *deviceSelector) matches(d blockDevice) string {
+	if s.model != nil && !s.model.MatchString(strings.TrimSpace(d.Model)) {
+		return fmt.Sprintf("model %q does not match %s", d.Model, s.model)
+	}
+	if s.serial != nil && !s.serial.MatchString(strings.TrimSpace(d.Serial)) {
+		return fmt.Sprintf("serial %q does not match %s", d.Serial, s.serial)
+	}
+	if s.rotational != nil && *s.rotational != d.Rotational {
+		return fmt.Sprintf("rotational is %t", d.Rotational)
+	}
+	if s.minSize > 0 && d.Size < s.minSize {
+		return fmt.Sprintf("size %d is smaller than %d", d.Size, s.minSize)
+	}
+	if s.maxSize > 0 && d.Size > s.maxSize {
+		return fmt.Sprintf("size %d is bigger than %d", d.Size, s.maxSize)
+	}
+	if len(s.transports) > 0 && !slices.Contains(s.transports, d.Transport) {
+		return fmt.Sprintf("transport %q is not one of %s", d.Transport, s.transports)
+	}
+	return ""
+}
+
+// mounts returns all active mounts of the device and its children, lsblk only sees the mount namespace of the container,
+// the mounts of the node are given by major:minor
+func (d blockDevice) mounts(nodeMounts map[string][]string) []string {
+	var mounts []string
+	for _, m := range append(d.Mountpoints, nodeMounts[d.MajMin]...) {
+		if m != "" && !slices.Contains(mounts, m) {
+			mounts = append(mounts, m)
+		}
+	}
+	for _, c := range d.Children {
+		mounts = append(mounts, c.mounts(nodeMounts)...)
+	}
+	return mounts
+}
+
+// lsblk returns the properties of the given devices
+func lsblk(paths ...string) ([]blockDevice, error) {
+	args := []string{"--json", "--bytes", "--output", "NAME,PATH,MAJ:MIN,SIZE,ROTA,TRAN,MODEL,SERIAL,TYPE,FSTYPE,PTTYPE,MOUNTPOINTS"}
+	args = append(args, paths...)
+	cmd := exec.Command("lsblk", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list block devices %s err:%w", paths, err)
+	}
+	var result lsblkOutput
+	err = json.Unmarshal(out, &result)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse lsblk output:%s err:%w", out, err)
+	}
+	return result.BlockDevices, nil
+}
+
+// devices returns all devices which match the selector
+func devices(selector *deviceSelector) ([]blockDevice, error) {
+	var candidates []string
+	for _, devicePattern := range selector.patterns {
+		klog.Infof("search devices :%s ", devicePattern)
+		matches, err := filepath.Glob(devicePattern)
+		if err != nil {
+			return nil, err
+		}
+		klog.Infof("found: %s", matches)
+		for _, match := range matches {
+			// resolve symlinks like /dev/disk/by-id/nvme-... to the real device
+			device, err := filepath.EvalSymlinks(match)
+			if err != nil {
+				return nil, fmt.Errorf("unable to resolve device %s err:%w", match, err)
+			}
+			if !slices.Contains(candidates, device) {
+				candidates = append(candidates, device)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	blockDevices, err := lsblk(candidates...)
+	if err != nil {
+		return nil, err
+	}
+	var result []blockDevice
+	for _, d := range blockDevices {
+		if reason := selector.matches(d); reason != "" {
+			klog.Infof("skip device %s: %s", d.Path, reason)
+			continue
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestDeviceSelectorMatches(t *testing.T) {
+	rotational := false
+	nvme := blockDevice{Path: "/dev/nvme0n1", Size: 1 << 40, Transport: "nvme", Model: "SAMSUNG MZQL21T9HCJR-00A07  ", Serial: "S64GNE0R", Type: "disk"}
+	hdd := blockDevice{Path: "/dev/sda", Size: 4 << 40, Rotational: true, Transport: "sata", Model: "ST4000NM000A", Serial: "WS2", Type: "disk"}
+
+	tests := []struct {
+		name     string
+		selector deviceSelector
+		device   blockDevice
+		match    bool
+	}{
+		{name: "no properties", device: hdd, match: true},
+		{name: "model with trailing spaces", selector: deviceSelector{model: regexp.MustCompile("^SAMSUNG MZQL2.*R-00A07$")}, device: nvme, match: true},
+		{name: "other model", selector: deviceSelector{model: regexp.MustCompile("^SAMSUNG")}, device: hdd},
+		{name: "serial", selector: deviceSelector{serial: regexp.MustCompile("^S64")}, device: nvme, match: true},
+		{name: "other serial", selector: deviceSelector{serial: regexp.MustCompile("^S64")}, device: hdd},
+		{name: "non rotational", selector: deviceSelector{rotational: &rotational}, device: nvme, match: true},
+		{name: "rotational", selector: deviceSelector{rotational: &rotational}, device: hdd},
+		{name: "min size", selector: deviceSelector{minSize: 2 << 40}, device: hdd, match: true},
+		{name: "too small", selector: deviceSelector{minSize: 2 << 40}, device: nvme},
+		{name: "max size", selector: deviceSelector{maxSize: 2 << 40}, device: nvme, match: true},
+		{name: "too big", selector: deviceSelector{maxSize: 2 << 40}, device: hdd},
+		{name: "transport", selector: deviceSelector{transports: []string{"nvme", "sas"}}, device: nvme, match: true},
+		{name: "other transport", selector: deviceSelector{transports: []string{"nvme", "sas"}}, device: hdd},
+		{name: "unknown transport", selector: deviceSelector{transports: []string{"nvme"}}, device: blockDevice{Path: "/dev/loop0"}},
+		{
+			name:     "all properties",
+			selector: deviceSelector{model: regexp.MustCompile("SAMSUNG"), rotational: &rotational, minSize: 1 << 30, maxSize: 2 << 40, transports: []string{"nvme"}},
+			device:   nvme,
+			match:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := tt.selector.matches(tt.device)
+			if tt.match != (reason == "") {
+				t.Errorf("matches() = %q, want match %v", reason, tt.match)
+			}
+		})
+	}
+}
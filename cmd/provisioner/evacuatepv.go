@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// evacuateDeviceAnnotation on a node names a physical volume which should be evacuated and removed from the volume group
+	evacuateDeviceAnnotation = "csi-lvm.metal-stack.io/evacuate-device"
+	// evacuateStatusAnnotation holds the evacuationStatus as json
+	evacuateStatusAnnotation = "csi-lvm.metal-stack.io/evacuate-status"
+	// addDeviceAnnotation on a node names a device which should be added to the volume group, e.g. the replacement of an evacuated one
+	addDeviceAnnotation = "csi-lvm.metal-stack.io/add-device"
+	// addDeviceStatusAnnotation holds the addDeviceStatus of a failed addition as json
+	addDeviceStatusAnnotation = "csi-lvm.metal-stack.io/add-device-status"
+
+	evacuationRunning   = "Running"
+	evacuationBlocked   = "Blocked"
+	evacuationCompleted = "Completed"
+	evacuationFailed    = "Failed"
+
+	flagDevice = "device"
+)
+
+// raidSubLV matches the hidden sub volumes of raid logical volumes
+var raidSubLV = regexp.MustCompile(`^\[?(.+)_(rimage|rmeta)_[0-9]+\]?$`)
+
+// evacuationStatus is reported in the evacuate-status annotation of the node
+type evacuationStatus struct {
+	Device          string   `json:"device"`
+	Phase           string   `json:"phase"`
+	Moved           int      `json:"moved"`
+	Total           int      `json:"total"`
+	BlockingVolumes []string `json:"blockingVolumes,omitempty"`
+	Message         string   `json:"message,omitempty"`
+	LastUpdate      string   `json:"lastUpdate"`
+}
+
+// addDeviceStatus is reported in the add-device-status annotation of the node if the device could not be added
+type addDeviceStatus struct {
+	Device     string `json:"device"`
+	Phase      string `json:"phase"`
+	Message    string `json:"message,omitempty"`
+	LastUpdate string `json:"lastUpdate"`
+}
+
+func evacuatePVCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "evacuatepv",
+		Usage: "move all extents off a physical volume and remove it from the volumegroup",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+				Value: "csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:  flagDevice,
+				Usage: "Required. the physical volume to evacuate",
+			},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Optional. the name of the node to emit events for",
+				EnvVars: []string{envNodeName},
+			},
+		},
+		Action: func(c *cli.Context) error {
+			vgName := c.String(flagVGName)
+			if vgName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagVGName)
+			}
+			device := c.String(flagDevice)
+			if device == "" {
+				return fmt.Errorf("invalid empty flag %v", flagDevice)
+			}
+			status := evacuatePV(c.Context, newEventRecorder(c.String(flagNodeName)), vgName, device)
+			if status.Phase != evacuationCompleted {
+				klog.Fatalf("Error evacuating pv %s: %s %s blocking:%s", device, status.Phase, status.Message, status.BlockingVolumes)
+			}
+			return nil
+		},
+	}
+}
+
+func addPVCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "addpv",
+		Usage: "add a device to the volumegroup, e.g. to replace an evacuated one",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+				Value: "csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:  flagDevice,
+				Usage: "Required. the device to add",
+			},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Optional. the name of the node to emit events for",
+				EnvVars: []string{envNodeName},
+			},
+		},
+		Action: func(c *cli.Context) error {
+			vgName := c.String(flagVGName)
+			if vgName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagVGName)
+			}
+			device := c.String(flagDevice)
+			if device == "" {
+				return fmt.Errorf("invalid empty flag %v", flagDevice)
+			}
+			if err := addPV(c.Context, newEventRecorder(c.String(flagNodeName)), vgName, device); err != nil {
+				klog.Fatalf("Error adding pv: %v", err)
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// evacuatePV moves all logical volumes off the given physical volume and removes it from the volumegroup.
+// The progress is reported as node events and in the evacuate-status annotation of the node.
+func evacuatePV(ctx context.Context, recorder *eventRecorder, vgName, device string) evacuationStatus {
+	status := evacuationStatus{Device: device, Phase: evacuationRunning}
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		status.Phase = evacuationFailed
+		status.Message = fmt.Sprintf("unable to resolve device: %v", err)
+		reportEvacuation(ctx, recorder, status)
+		return status
+	}
+	pvs, err := physicalVolumes(ctx)
+	if err != nil {
+		status.Phase = evacuationFailed
+		status.Message = err.Error()
+		reportEvacuation(ctx, recorder, status)
+		return status
+	}
+	if pvs[resolved] != vgName {
+		status.Phase = evacuationCompleted
+		status.Message = fmt.Sprintf("device is not part of volume group %s", vgName)
+		reportEvacuation(ctx, recorder, status)
+		return status
+	}
+
+	lvs, err := lvsOnPV(ctx, vgName, resolved)
+	if err != nil {
+		status.Phase = evacuationFailed
+		status.Message = err.Error()
+		reportEvacuation(ctx, recorder, status)
+		return status
+	}
+	status.Total = len(lvs)
+	recorder.nodeEvent(ctx, v1.EventTypeNormal, "EvacuationStarted", "moving %d volumes off %s", len(lvs), device)
+	reportEvacuation(ctx, recorder, status)
+
+	for _, lv := range lvs {
+		err := moveLV(ctx, vgName, lv, resolved)
+		if err != nil {
+			klog.Errorf("unable to move lv %s off %s: %v", lv.name, resolved, err)
+			status.BlockingVolumes = append(status.BlockingVolumes, lv.name)
+			recorder.volumeEvent(ctx, lv.name, v1.EventTypeWarning, "EvacuationBlocked", "volume can not be moved off %s: %v", device, err)
+			continue
+		}
+		status.Moved++
+		recorder.volumeEvent(ctx, lv.name, v1.EventTypeNormal, "VolumeMoved", "volume moved off %s", device)
+		reportEvacuation(ctx, recorder, status)
+	}
+	if len(status.BlockingVolumes) > 0 {
+		status.Phase = evacuationBlocked
+		status.Message = "not all volumes could be moved, free space on other physical volumes is required"
+		recorder.nodeEvent(ctx, v1.EventTypeWarning, "EvacuationBlocked", "device %s can not be removed, blocking volumes:%s", device, status.BlockingVolumes)
+		reportEvacuation(ctx, recorder, status)
+		return status
+	}
+
+	for _, args := range [][]string{{"vgreduce", vgName, resolved}, {"pvremove", resolved}} {
+		klog.Infof("evacuate pv command: %s", args)
+		_, err := lvm.Run(ctx, args[0], args[1:]...)
+		if err != nil {
+			status.Phase = evacuationFailed
+			status.Message = err.Error()
+			recorder.nodeEvent(ctx, v1.EventTypeWarning, "EvacuationFailed", "device %s: %s", device, status.Message)
+			reportEvacuation(ctx, recorder, status)
+			return status
+		}
+	}
+	status.Phase = evacuationCompleted
+	status.Message = "device can be removed"
+	recorder.nodeEvent(ctx, v1.EventTypeNormal, "EvacuationCompleted", "device %s removed from volume group %s", device, vgName)
+	reportEvacuation(ctx, recorder, status)
+	return status
+}
+
+func reportEvacuation(ctx context.Context, recorder *eventRecorder, status evacuationStatus) {
+	status.LastUpdate = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(status)
+	if err != nil {
+		klog.Errorf("unable to marshal evacuation status: %v", err)
+		return
+	}
+	klog.Infof("evacuation status: %s", data)
+	if recorder.client == nil {
+		return
+	}
+	value := string(data)
+	err = recorder.annotateNode(ctx, map[string]*string{evacuateStatusAnnotation: &value})
+	if err != nil {
+		klog.Errorf("unable to update evacuation status: %v", err)
+	}
+}
+
+// pvLV is a logical volume with extents on a physical volume
+type pvLV struct {
+	name string
+	raid bool
+}
+
+// lvsOnPV returns all logical volumes with extents on the given physical volume
+func lvsOnPV(ctx context.Context, vgName, device string) ([]pvLV, error) {
+	segments, err := lvm.Segments(ctx, vgName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list segments of vg %s err:%w", vgName, err)
+	}
+	var result []pvLV
+	for _, segment := range segments {
+		onPV := slices.ContainsFunc(segment.Devices, func(d string) bool { return strings.HasPrefix(d, device+"(") })
+		if !onPV {
+			continue
+		}
+		lv := pvLV{name: strings.Trim(segment.LVName, "[]")}
+		if m := raidSubLV.FindStringSubmatch(segment.LVName); m != nil {
+			lv = pvLV{name: m[1], raid: true}
+		}
+		if !slices.Contains(result, lv) {
+			result = append(result, lv)
+		}
+	}
+	return result, nil
+}
+
+// moveLV moves the extents of a logical volume off the physical volume.
+// raid legs can not be moved with pvmove, they are replaced by a new leg on another physical volume.
+func moveLV(ctx context.Context, vgName string, lv pvLV, device string) error {
+	args := []string{"pvmove", "--name", lv.name, device}
+	if lv.raid {
+		args = []string{"lvconvert", "--yes", "--replace", device, vgName + "/" + lv.name}
+	}
+	klog.Infof("move lv command: %s", args)
+	_, err := lvm.Run(ctx, args[0], args[1:]...)
+	return err
+}
+
+// addPV adds a device to the volumegroup after it passed the preflight check
+func addPV(ctx context.Context, recorder *eventRecorder, vgName, device string) error {
+	candidates, err := lsblk(device)
+	if err != nil {
+		return err
+	}
+	checks, err := preflight(ctx, recorder, vgName, candidates)
+	if err != nil {
+		return fmt.Errorf("unable to check devices, err:%w", err)
+	}
+	reportPreflight(ctx, recorder, vgName, checks)
+	physicalVolumes, err := prepareDevices(checks)
+	if err != nil {
+		return err
+	}
+	if len(physicalVolumes) == 0 {
+		return fmt.Errorf("device %s refused by preflight check", device)
+	}
+	args := []string{"--verbose", vgName}
+	args = append(args, physicalVolumes...)
+	klog.Infof("add pv with command: vgextend %v", args)
+	_, err = lvm.Run(ctx, "vgextend", args...)
+	if err != nil {
+		recorder.nodeEvent(ctx, v1.EventTypeWarning, "VolumeGroupExtendFailed", "unable to extend volume group %s with %s: %v", vgName, physicalVolumes, err)
+		return fmt.Errorf("unable to extend vg %s with %s err:%w", vgName, physicalVolumes, err)
+	}
+	recorder.nodeEvent(ctx, v1.EventTypeNormal, "VolumeGroupExtended", "volume group %s extended with %s", vgName, physicalVolumes)
+	return nil
+}
+
+// deviceMaintainer runs the device maintenance requested by annotations of the node in the background,
+// an evacuation with pvmove may take hours and must not block the reconciliation of the mounts
+type deviceMaintainer struct {
+	recorder *eventRecorder
+	vgName   string
+	running  atomic.Bool
+}
+
+// start runs the device maintenance unless the previous one is still running
+func (d *deviceMaintainer) start(ctx context.Context) {
+	if !d.running.CompareAndSwap(false, true) {
+		klog.Info("device maintenance is still running")
+		return
+	}
+	go func() {
+		defer d.running.Store(false)
+		deviceMaintenance(ctx, d.recorder, d.vgName)
+	}()
+}
+
+// deviceMaintenance runs the evacuation and addition of devices requested by annotations of the node.
+// A failed or blocked evacuation and a failed addition are not retried until the annotation or the status annotation changes.
+func deviceMaintenance(ctx context.Context, recorder *eventRecorder, vgName string) {
+	node, err := recorder.node(ctx)
+	if err != nil {
+		klog.Infof("unable to read device maintenance annotations: %v", err)
+		return
+	}
+
+	if device := node.Annotations[evacuateDeviceAnnotation]; device != "" {
+		var status evacuationStatus
+		if data := node.Annotations[evacuateStatusAnnotation]; data != "" {
+			err := json.Unmarshal([]byte(data), &status)
+			if err != nil {
+				klog.Errorf("unable to parse evacuation status %s: %v", data, err)
+			}
+		}
+		// a running evacuation was interrupted, e.g. by a restart of the reviver
+		if status.Device != device || status.Phase == evacuationRunning {
+			evacuatePV(ctx, recorder, vgName, device)
+		} else if status.Phase != evacuationCompleted {
+			klog.Infof("evacuation of %s is %s, remove annotation %s to retry", device, status.Phase, evacuateStatusAnnotation)
+		}
+	}
+
+	if device := node.Annotations[addDeviceAnnotation]; device != "" {
+		var status addDeviceStatus
+		if data := node.Annotations[addDeviceStatusAnnotation]; data != "" {
+			err := json.Unmarshal([]byte(data), &status)
+			if err != nil {
+				klog.Errorf("unable to parse add device status %s: %v", data, err)
+			}
+		}
+		if status.Device == device && status.Phase == evacuationFailed {
+			klog.Infof("adding %s failed, remove annotation %s to retry", device, addDeviceStatusAnnotation)
+			return
+		}
+		err := addPV(ctx, recorder, vgName, device)
+		if err != nil {
+			klog.Errorf("unable to add device %s: %v", device, err)
+			status = addDeviceStatus{Device: device, Phase: evacuationFailed, Message: err.Error(), LastUpdate: time.Now().UTC().Format(time.RFC3339)}
+			data, err := json.Marshal(status)
+			if err != nil {
+				klog.Errorf("unable to marshal add device status: %v", err)
+				return
+			}
+			value := string(data)
+			err = recorder.annotateNode(ctx, map[string]*string{addDeviceStatusAnnotation: &value})
+			if err != nil {
+				klog.Errorf("unable to update add device status: %v", err)
+			}
+			return
+		}
+		err = recorder.annotateNode(ctx, map[string]*string{addDeviceAnnotation: nil, addDeviceStatusAnnotation: nil})
+		if err != nil {
+			klog.Errorf("unable to remove annotation %s: %v", addDeviceAnnotation, err)
+		}
+	}
+}
+
+// evacuatedDevices returns the device named in the evacuate-device annotation, it must not be added again.
+func evacuatedDevices(ctx context.Context, recorder *eventRecorder) []string {
+	node, err := recorder.node(ctx)
+	if err != nil {
+		return nil
+	}
+	device := node.Annotations[evacuateDeviceAnnotation]
+	if device == "" {
+		return nil
+	}
+	resolved, err := filepath.EvalSymlinks(device)
+	if err == nil {
+		device = resolved
+	}
+	return []string{device}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// vgExtender adds devices which appear later on the node and match the selector to the volume group
+type vgExtender struct {
+	recorder *eventRecorder
+	vgName   string
+	selector *deviceSelector
+	// refused remembers the reason per refused device to report every refusal only once
+	refused map[string]string
+}
+
+func newVGExtender(recorder *eventRecorder, vgName string, selector *deviceSelector) *vgExtender {
+	return &vgExtender{
+		recorder: recorder,
+		vgName:   vgName,
+		selector: selector,
+		refused:  map[string]string{},
+	}
+}
+
+// extend compares the devices matching the selector with the physical volumes of the volume group
+// and extends the volume group with all new devices which pass the preflight check.
+func (e *vgExtender) extend(ctx context.Context) error {
+	if !vgExists(e.vgName) {
+		// the volume group is created with the first volume
+		klog.Infof("volumegroup: %s not found, nothing to extend", e.vgName)
+		return nil
+	}
+	candidates, err := devices(e.selector)
+	if err != nil {
+		return fmt.Errorf("unable to lookup devices from %s, err:%w", e.selector, err)
+	}
+	pvs, err := physicalVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	evacuated := evacuatedDevices(ctx, e.recorder)
+	var newDevices []blockDevice
+	for _, d := range candidates {
+		if pvs[d.Path] == e.vgName {
+			continue
+		}
+		if slices.Contains(evacuated, d.Path) {
+			klog.Infof("skip device %s, it is evacuated", d.Path)
+			continue
+		}
+		newDevices = append(newDevices, d)
+	}
+	if len(newDevices) == 0 {
+		return nil
+	}
+
+	checks, err := preflight(ctx, e.recorder, e.vgName, newDevices)
+	if err != nil {
+		return fmt.Errorf("unable to check devices, err:%w", err)
+	}
+	var changed []deviceCheck
+	for _, c := range checks {
+		if c.usable() {
+			delete(e.refused, c.device.Path)
+			changed = append(changed, c)
+			continue
+		}
+		if e.refused[c.device.Path] != c.reason {
+			e.refused[c.device.Path] = c.reason
+			changed = append(changed, c)
+		}
+	}
+	reportPreflight(ctx, e.recorder, e.vgName, changed)
+
+	physicalVolumes, err := prepareDevices(checks)
+	if err != nil {
+		return err
+	}
+	if len(physicalVolumes) == 0 {
+		return nil
+	}
+
+	args := []string{"--verbose", e.vgName}
+	args = append(args, physicalVolumes...)
+	klog.Infof("extend vg with command: vgextend %v", args)
+	_, err = lvm.Run(ctx, "vgextend", args...)
+	if err != nil {
+		e.recorder.nodeEvent(ctx, v1.EventTypeWarning, "VolumeGroupExtendFailed", "unable to extend volume group %s with %s: %v", e.vgName, physicalVolumes, err)
+		return fmt.Errorf("unable to extend vg %s with %s err:%w", e.vgName, physicalVolumes, err)
+	}
+	e.recorder.nodeEvent(ctx, v1.EventTypeNormal, "VolumeGroupExtended", "volume group %s extended with %s", e.vgName, physicalVolumes)
+	return nil
+}
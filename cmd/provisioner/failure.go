@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/provisionerpod"
+	"k8s.io/klog/v2"
+)
+
+// errConflict is returned if a logical volume of the same name but of another claim or shape exists
+var errConflict = errors.New("conflict")
+
+// invalidArgumentError marks errors which occur again if the command is retried with the same arguments
+type invalidArgumentError struct {
+	error
+}
+
+func (e invalidArgumentError) Unwrap() error {
+	return e.error
+}
+
+func invalidArgument(err error) error {
+	return invalidArgumentError{err}
+}
+
+// failureReason classifies an error of the provisioner for the controller
+func failureReason(err error) provisionerpod.Reason {
+	var invalid invalidArgumentError
+	switch {
+	case errors.As(err, &invalid):
+		return provisionerpod.ReasonInvalid
+	case errors.Is(err, errConflict):
+		return provisionerpod.ReasonConflict
+	case errors.Is(err, errBusy):
+		return provisionerpod.ReasonBusy
+	case errors.Is(err, lvm.ErrInsufficientSpace), errors.Is(err, lvm.ErrMissingPV):
+		return provisionerpod.ReasonInsufficientSpace
+	case errors.Is(err, lvm.ErrLocked), errors.Is(err, context.DeadlineExceeded):
+		return provisionerpod.ReasonTransient
+	}
+	return provisionerpod.ReasonUnknown
+}
+
+// terminate reports the failure to the controller which created the provisioner pod
+func terminate(err error) {
+	reason := failureReason(err)
+	klog.Infof("failure reason:%s", reason)
+	if e := provisionerpod.Terminate(reason, err); e != nil {
+		klog.Errorf("unable to write termination message: %v", e)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/provisionerpod"
+)
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want provisionerpod.Reason
+	}{
+		{
+			name: "invalid argument",
+			err:  invalidArgument(errors.New("invalid lvm type")),
+			want: provisionerpod.ReasonInvalid,
+		},
+		{
+			name: "invalid argument wins over the lvm error",
+			err:  invalidArgument(fmt.Errorf("unable to create lv err:%w", lvm.ErrInsufficientSpace)),
+			want: provisionerpod.ReasonInvalid,
+		},
+		{
+			name: "conflict",
+			err:  fmt.Errorf("lv pvc-1 belongs to another claim %w", errConflict),
+			want: provisionerpod.ReasonConflict,
+		},
+		{
+			name: "busy",
+			err:  fmt.Errorf("volume is mounted err:%w", errBusy),
+			want: provisionerpod.ReasonBusy,
+		},
+		{
+			name: "insufficient space",
+			err:  fmt.Errorf("unable to create lv err:%w", lvm.ErrInsufficientSpace),
+			want: provisionerpod.ReasonInsufficientSpace,
+		},
+		{
+			name: "missing physical volume",
+			err:  fmt.Errorf("unable to create lv err:%w", lvm.ErrMissingPV),
+			want: provisionerpod.ReasonInsufficientSpace,
+		},
+		{
+			name: "locked",
+			err:  fmt.Errorf("unable to create lv err:%w", lvm.ErrLocked),
+			want: provisionerpod.ReasonTransient,
+		},
+		{
+			name: "timeout",
+			err:  fmt.Errorf("unable to create lv err:%w", context.DeadlineExceeded),
+			want: provisionerpod.ReasonTransient,
+		},
+		{
+			name: "not found",
+			err:  fmt.Errorf("unable to create lv err:%w", lvm.ErrNotFound),
+			want: provisionerpod.ReasonUnknown,
+		},
+		{
+			name: "unknown",
+			err:  errors.New("mkfs failed"),
+			want: provisionerpod.ReasonUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err); got != tt.want {
+				t.Errorf("failureReason() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// fsckNever never checks the filesystem before it is mounted
+	fsckNever = "never"
+	// fsckPreen checks the filesystem if it was not unmounted cleanly and repairs it if this is safe
+	fsckPreen = "preen"
+	// fsckAlways checks the filesystem before every mount and repairs it if this is safe
+	fsckAlways = "always"
+
+	// fsckTagPrefix is the lv tag which holds the fsck policy of the storageclass
+	fsckTagPrefix = "fsck="
+	// quarantineTag marks a volume which needs a manual repair, it is only mounted read-only
+	quarantineTag = "fsck.quarantined"
+)
+
+// e2fsck exit codes, see man e2fsck
+const (
+	fsckCorrected       = 1
+	fsckCorrectedReboot = 2
+	fsckUncorrected     = 4
+	// fsckOperational and higher codes mean the filesystem was not checked, e.g. the superblock is unreadable
+	fsckOperational = 8
+)
+
+func validFsckPolicy(policy string) error {
+	switch policy {
+	case fsckNever, fsckPreen, fsckAlways:
+		return nil
+	default:
+		return fmt.Errorf("invalid fsck policy %q, must be one of %s, %s or %s", policy, fsckNever, fsckPreen, fsckAlways)
+	}
+}
+
+// fsckPolicy returns the fsck policy of a logical volume, volumes created without are preened
+func fsckPolicy(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, fsckTagPrefix) {
+			return strings.TrimPrefix(tag, fsckTagPrefix)
+		}
+	}
+	return fsckPreen
+}
+
+// fsckResult is the outcome of an e2fsck run
+type fsckResult int
+
+const (
+	fsckClean fsckResult = iota
+	fsckRepaired
+	// fsckNotChecked means e2fsck did not check the filesystem, e.g. the device was busy, the mount is retried later
+	fsckNotChecked
+	// fsckUnrepairable means e2fsck found errors it can not repair, the volume is quarantined
+	fsckUnrepairable
+)
+
+// fsckResultOf maps the exit code of e2fsck to its outcome
+func fsckResultOf(code int) fsckResult {
+	switch {
+	case code >= fsckOperational:
+		return fsckNotChecked
+	case code&fsckUncorrected != 0:
+		return fsckUnrepairable
+	case code&(fsckCorrected|fsckCorrectedReboot) != 0:
+		return fsckRepaired
+	}
+	return fsckClean
+}
+
+// checkFilesystem checks the filesystem of an existing logical volume according to its policy before it is mounted.
+// It returns true if the volume is quarantined and must only be mounted read-only, and an error if the filesystem could not be checked.
+func checkFilesystem(ctx context.Context, recorder *eventRecorder, vgName string, lv *lvm.LV) (bool, error) {
+	if slices.Contains(lv.Tags, quarantineTag) {
+		recorder.volumeEvent(ctx, lv.Name, v1.EventTypeWarning, "FilesystemQuarantined", "filesystem needs a manual repair, it is mounted read-only until the %s tag is removed", quarantineTag)
+		return true, nil
+	}
+	policy := fsckPolicy(lv.Tags)
+	var args []string
+	switch policy {
+	case fsckNever:
+		return false, nil
+	case fsckAlways:
+		args = []string{"-f", "-p"}
+	default:
+		args = []string{"-p"}
+	}
+	if lv.Open {
+		// e.g. bind mounts of pods still hold the volume, e2fsck refuses to check it and it must not be repaired meanwhile
+		recorder.volumeEvent(ctx, lv.Name, v1.EventTypeNormal, "FilesystemCheckSkipped", "volume is still in use, the filesystem is not checked")
+		return false, nil
+	}
+	lvPath := fmt.Sprintf("/dev/%s/%s", vgName, lv.Name)
+	args = append(args, lvPath)
+	klog.Infof("fsck command: e2fsck %s", args)
+	out, err := exec.Command("e2fsck", args...).CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if err == nil {
+		if policy == fsckAlways {
+			recorder.volumeEvent(ctx, lv.Name, v1.EventTypeNormal, "FilesystemChecked", "filesystem is clean")
+		}
+		return false, nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false, fmt.Errorf("unable to run e2fsck err:%w", err)
+	}
+	code := exitErr.ExitCode()
+	switch fsckResultOf(code) {
+	case fsckNotChecked:
+		// e.g. the device is busy or an i/o error, the volume is neither mounted nor quarantined before it was checked
+		return false, fmt.Errorf("unable to check filesystem, e2fsck exit code %d: %s", code, output)
+	case fsckUnrepairable:
+		quarantine(ctx, recorder, vgName, lv.Name, "filesystem errors can not be repaired automatically, it is mounted read-only: %s", output)
+		return true, nil
+	case fsckRepaired:
+		recorder.volumeEvent(ctx, lv.Name, v1.EventTypeNormal, "FilesystemRepaired", "filesystem errors were repaired: %s", output)
+	}
+	return false, nil
+}
+
+// quarantine tags a volume which needs a manual repair, it is mounted read-only until the tag is removed
+func quarantine(ctx context.Context, recorder *eventRecorder, vgName, lvName, messageFmt string, args ...any) {
+	recorder.volumeEvent(ctx, lvName, v1.EventTypeWarning, "FilesystemQuarantined", messageFmt, args...)
+	err := lvm.AddTags(ctx, vgName, lvName, quarantineTag)
+	if err != nil {
+		klog.Errorf("unable to add tag %s to lv:%s error:%v", quarantineTag, lvName, err)
+	}
+}
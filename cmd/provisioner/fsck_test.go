@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestFsckResultOf(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		want fsckResult
+	}{
+		{name: "clean", code: 0, want: fsckClean},
+		{name: "corrected", code: 1, want: fsckRepaired},
+		{name: "corrected, reboot", code: 2, want: fsckRepaired},
+		{name: "uncorrected", code: 4, want: fsckUnrepairable},
+		{name: "partly corrected", code: 5, want: fsckUnrepairable},
+		{name: "operational error", code: 8, want: fsckNotChecked},
+		{name: "operational error with uncorrected errors", code: 12, want: fsckNotChecked},
+		{name: "usage error", code: 16, want: fsckNotChecked},
+		{name: "cancelled", code: 32, want: fsckNotChecked},
+		{name: "shared library error", code: 128, want: fsckNotChecked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fsckResultOf(tt.code); got != tt.want {
+				t.Errorf("fsckResultOf(%d) = %d, want %d", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFsckPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		want string
+	}{
+		{name: "no tags", want: fsckPreen},
+		{name: "always", tags: []string{"isBlock=false", "fsck=always"}, want: fsckAlways},
+		{name: "never", tags: []string{"fsck=never"}, want: fsckNever},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fsckPolicy(tt.tags); got != tt.want {
+				t.Errorf("fsckPolicy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
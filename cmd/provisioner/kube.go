@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+const (
+	eventComponent = "csi-lvm-provisioner"
+	// eventNamespace is where events of cluster scoped objects like nodes are stored
+	eventNamespace = "default"
+)
+
+// eventRecorder emits events for objects of the node this provisioner runs on.
+// Without access to the api server, events are only logged.
+type eventRecorder struct {
+	client   clientset.Interface
+	nodeName string
+}
+
+func newEventRecorder(nodeName string) *eventRecorder {
+	r := &eventRecorder{nodeName: nodeName}
+	if nodeName == "" {
+		klog.Infof("no node name given, events are only logged")
+		return r
+	}
+	client, err := newKubeClient()
+	if err != nil {
+		klog.Infof("no access to the api server, events are only logged:%v", err)
+		return r
+	}
+	r.client = client
+	return r
+}
+
+func newKubeClient() (clientset.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get client config %w", err)
+	}
+	client, err := clientset.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get k8s client %w", err)
+	}
+	return client, nil
+}
+
+// node returns the node this provisioner runs on
+func (r *eventRecorder) node(ctx context.Context) (*v1.Node, error) {
+	if r.client == nil {
+		return nil, fmt.Errorf("no access to the api server")
+	}
+	return r.client.CoreV1().Nodes().Get(ctx, r.nodeName, metav1.GetOptions{})
+}
+
+// annotateNode sets the given annotations on the node this provisioner runs on, nil values remove the annotation
+func (r *eventRecorder) annotateNode(ctx context.Context, annotations map[string]*string) error {
+	if r.client == nil {
+		return fmt.Errorf("no access to the api server")
+	}
+	patch := map[string]any{
+		"metadata": map[string]any{
+			"annotations": annotations,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.CoreV1().Nodes().Patch(ctx, r.nodeName, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+// volumeEvent emits an event on the persistent volume of the given logical volume and on its claim if bound
+func (r *eventRecorder) volumeEvent(ctx context.Context, lvName, eventtype, reason, messageFmt string, args ...any) {
+	message := fmt.Sprintf(messageFmt, args...)
+	ref := &v1.ObjectReference{
+		Kind: "PersistentVolume",
+		Name: lvName,
+	}
+	if r.client == nil {
+		r.event(ctx, ref, eventtype, reason, message)
+		return
+	}
+	pv, err := r.client.CoreV1().PersistentVolumes().Get(ctx, lvName, metav1.GetOptions{})
+	if err != nil {
+		if !k8serror.IsNotFound(err) {
+			klog.Errorf("unable to get persistent volume %s: %v", lvName, err)
+		}
+		klog.Infof("no persistent volume for lv %s, event %s is only logged: %s", lvName, reason, message)
+		return
+	}
+	ref.UID = pv.UID
+	ref.APIVersion = "v1"
+	r.event(ctx, ref, eventtype, reason, message)
+	if pv.Spec.ClaimRef != nil {
+		r.event(ctx, pv.Spec.ClaimRef, eventtype, reason, message)
+	}
+}
+
+// nodeEvent emits an event on the node this provisioner runs on
+func (r *eventRecorder) nodeEvent(ctx context.Context, eventtype, reason, messageFmt string, args ...any) {
+	ref := &v1.ObjectReference{
+		Kind: "Node",
+		Name: r.nodeName,
+		// the kubelet uses the node name as uid as well, kubectl describe node relies on it
+		UID: types.UID(r.nodeName),
+	}
+	r.event(ctx, ref, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *eventRecorder) event(ctx context.Context, ref *v1.ObjectReference, eventtype, reason, message string) {
+	if eventtype == v1.EventTypeWarning {
+		klog.Warningf("event %s/%s %s: %s", ref.Kind, ref.Name, reason, message)
+	} else {
+		klog.Infof("event %s/%s %s: %s", ref.Kind, ref.Name, reason, message)
+	}
+	if r.client == nil {
+		return
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = eventNamespace
+	}
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventtype,
+		Source: v1.EventSource{
+			Component: eventComponent,
+			Host:      r.nodeName,
+		},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: eventComponent,
+		ReportingInstance:   r.nodeName,
+	}
+	_, err := r.client.CoreV1().Events(namespace).Create(ctx, event, metav1.CreateOptions{})
+	if err != nil {
+		klog.Errorf("unable to create event %s for %s/%s: %v", reason, ref.Kind, ref.Name, err)
+	}
+}
@@ -16,6 +16,44 @@ const (
 	flagDirectory      = "directory"
 	flagLVMType        = "lvmtype"
 	flagBlockMode      = "block"
+	flagNodeName       = "nodename"
+	flagAutoExtend     = "auto-extend"
+	flagRaidRepair     = "raid-auto-repair"
+	flagDegraded       = "degraded-activation"
+	flagScrubInterval  = "scrub-interval"
+	flagScrubRate      = "scrub-rate"
+	flagScrubRepair    = "scrub-repair"
+	flagMetricsAddress = "metrics-address"
+	flagFsckPolicy     = "fsck-policy"
+	flagTag            = "tag"
+	flagFSLabel        = "fs-label"
+	flagKeepOnFailure  = "keep-on-failure"
+
+	flagReconcileInterval = "reconcile-interval"
+	flagTaint             = "node-taint"
+	flagTaintTimeout      = "node-taint-timeout"
+	flagTaintPolicy       = "node-taint-timeout-policy"
+	flagOrphanGracePeriod = "orphan-grace-period"
+	flagOrphanCleanup     = "orphan-cleanup"
+	flagOnce              = "once"
+
+	flagDeviceModel      = "device-model"
+	flagDeviceSerial     = "device-serial"
+	flagDeviceRotational = "device-rotational"
+	flagDeviceMinSize    = "device-min-size"
+	flagDeviceMaxSize    = "device-max-size"
+	flagDeviceTransport  = "device-transport"
+)
+
+var (
+	envNodeName         = "NODE_NAME"
+	envDevicesPattern   = "CSI_LVM_DEVICE_PATTERN"
+	envDeviceModel      = "CSI_LVM_DEVICE_MODEL"
+	envDeviceSerial     = "CSI_LVM_DEVICE_SERIAL"
+	envDeviceRotational = "CSI_LVM_DEVICE_ROTATIONAL"
+	envDeviceMinSize    = "CSI_LVM_DEVICE_MIN_SIZE"
+	envDeviceMaxSize    = "CSI_LVM_DEVICE_MAX_SIZE"
+	envDeviceTransport  = "CSI_LVM_DEVICE_TRANSPORT"
 )
 
 func cmdNotFound(c *cli.Context, command string) {
@@ -33,6 +71,12 @@ func main() {
 		createLVCmd(),
 		deleteLVCmd(),
 		reviveLVsCmd(),
+		evacuatePVCmd(),
+		addPVCmd(),
+		cleanOrphansCmd(),
+		recoverPVsCmd(),
+		adoptLVCmd(),
+		statusCmd(),
 	}
 	p.CommandNotFound = cmdNotFound
 	p.OnUsageError = onUsageError
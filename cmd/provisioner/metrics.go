@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "csi_lvm"
+
+var (
+	raidMismatchCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "raid_mismatch_count",
+		Help:      "Number of mismatches found by the last scrub of a raid volume.",
+	}, []string{"volume"})
+	raidScrubCompletion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "raid_scrub_completion_timestamp_seconds",
+		Help:      "Unix time the last scrub of a raid volume completed.",
+	}, []string{"volume"})
+	raidScrubs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "raid_scrubs_total",
+		Help:      "Number of completed scrubs by result.",
+	}, []string{"result"})
+	orphanCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphans",
+		Help:      "Number of logical volumes and mountpoints without a persistent volume by kind.",
+	}, []string{"kind"})
+	orphansRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphans_removed_total",
+		Help:      "Number of removed orphans by kind.",
+	}, []string{"kind"})
+	tagMigrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tag_migrations_total",
+		Help:      "Number of migrations of lv tags by target schema version and result.",
+	}, []string{"version", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(raidMismatchCount, raidScrubCompletion, raidScrubs, orphanCount, orphansRemoved, tagMigrations)
+}
+
+// serveMetrics serves the prometheus metrics on the given address in the background
+func serveMetrics(address string) {
+	if address == "" {
+		klog.Info("metrics are disabled")
+		return
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		klog.Infof("serving metrics on %s", address)
+		err := http.ListenAndServe(address, nil)
+		if err != nil {
+			klog.Errorf("unable to serve metrics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// migration brings the tags of a logical volume to its version, it returns the tags to add
+type migration struct {
+	version     int
+	description string
+	migrate     func(lv *lvm.LV, mountPath string) ([]string, error)
+}
+
+// migrations must be ordered by version, the last one is volume.SchemaVersion.
+// Every step must be idempotent, it may run again if the schema tag could not be updated.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "add csi-lvm and isBlock tags to volumes of csi-lvm v0.4.x",
+		migrate: func(lv *lvm.LV, mountPath string) ([]string, error) {
+			tags := []string{lvTag}
+			if lv.HasTag("isBlock=true") || lv.HasTag("isBlock=false") {
+				return tags, nil
+			}
+			// volumes of csi-lvm v0.4.x are only recognized by their mountpoint
+			tp, err := os.Lstat(mountPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to inspect %s: %w", mountPath, err)
+			}
+			return append(tags, "isBlock="+strconv.FormatBool(!tp.Mode().IsDir())), nil
+		},
+	},
+	{
+		version:     2,
+		description: "add the default fsck policy to filesystem volumes",
+		migrate: func(lv *lvm.LV, _ string) ([]string, error) {
+			if isBlockLV(lv) || slices.ContainsFunc(lv.Tags, func(tag string) bool { return strings.HasPrefix(tag, fsckTagPrefix) }) {
+				return nil, nil
+			}
+			return []string{fsckTagPrefix + fsckPreen}, nil
+		},
+	},
+	{
+		version:     3,
+		description: "add the filesystem type to filesystem volumes",
+		migrate: func(lv *lvm.LV, _ string) ([]string, error) {
+			if isBlockLV(lv) {
+				return nil, nil
+			}
+			return []string{volume.FSTypeTag("ext4")}, nil
+		},
+	},
+}
+
+// migrateLVs applies all pending migrations to the tags of every logical volume of csi-lvm
+func migrateLVs(ctx context.Context, vgName, dirName string) {
+	lvs, err := lvm.LVs(ctx, vgName)
+	if err != nil {
+		if !errors.Is(err, lvm.ErrNotFound) {
+			klog.Errorf("unable to list logical volumes for migration: %v", err)
+		}
+		return
+	}
+	for _, lv := range lvs {
+		if lv.Hidden() {
+			continue
+		}
+		mountPath := path.Join(dirName, lv.Name)
+		if !lv.HasTag(lvTag) {
+			// untagged volumes are only ours if they are mounted by csi-lvm
+			mounted, err := isMountpoint(mountPath)
+			if err != nil || !mounted {
+				continue
+			}
+		}
+		migrateLV(ctx, vgName, &lv, mountPath)
+	}
+}
+
+// tagUntaggedLVs tags the logical volumes of csi-lvm before v0.5.0 which are not mounted but belong to a persistent volume of this node,
+// its volume mode decides whether it is a block volume, then they are migrated like all others
+func (r *reviver) tagUntaggedLVs(ctx context.Context) {
+	if r.pvLister == nil {
+		return
+	}
+	pvs, err := r.localPVs()
+	if err != nil {
+		klog.Errorf("unable to list persistent volumes: %v", err)
+		return
+	}
+	lvs, err := lvm.LVs(ctx, r.vgName)
+	if err != nil {
+		if !errors.Is(err, lvm.ErrNotFound) {
+			klog.Errorf("unable to list logical volumes: %v", err)
+		}
+		return
+	}
+	for _, lv := range lvs {
+		pv := pvs[lv.Name]
+		if pv == nil || lv.Hidden() || lv.HasTag(lvTag) {
+			continue
+		}
+		blockMode := pv.Spec.VolumeMode != nil && *pv.Spec.VolumeMode == v1.PersistentVolumeBlock
+		tags := []string{lvTag, "isBlock=" + strconv.FormatBool(blockMode)}
+		err := lvm.AddTags(ctx, r.vgName, lv.Name, tags...)
+		if err != nil {
+			klog.Errorf("unable to tag lv %s of persistent volume: %v", lv.Name, err)
+			continue
+		}
+		klog.Infof("untagged lv %s of persistent volume tagged with %s", lv.Name, strings.Join(tags, ","))
+		lv.Tags = append(lv.Tags, tags...)
+		migrateLV(ctx, r.vgName, &lv, path.Join(r.dirName, lv.Name))
+	}
+}
+
+// migrateLV applies the pending migrations to one logical volume, it stops at the first failing step
+func migrateLV(ctx context.Context, vgName string, lv *lvm.LV, mountPath string) {
+	current := volume.Schema(lv.Tags)
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		klog.Infof("migrate tags of lv %s from version %d to %d: %s", lv.Name, current, m.version, m.description)
+		tags, err := m.migrate(lv, mountPath)
+		if err != nil {
+			klog.Errorf("unable to migrate tags of lv %s to version %d: %v", lv.Name, m.version, err)
+			tagMigrations.WithLabelValues(strconv.Itoa(m.version), "failed").Inc()
+			return
+		}
+		// the new tags and the new schema version are changed at once
+		args := []string{}
+		for _, tag := range tags {
+			if !lv.HasTag(tag) {
+				args = append(args, "--addtag", tag)
+			}
+		}
+		args = append(args, "--addtag", volume.SchemaTag(m.version))
+		if current > 0 {
+			args = append(args, "--deltag", volume.SchemaTag(current))
+		}
+		args = append(args, vgName+"/"+lv.Name)
+		_, err = lvm.Run(ctx, "lvchange", args...)
+		if err != nil {
+			klog.Errorf("unable to migrate tags of lv %s to version %d: %v", lv.Name, m.version, err)
+			tagMigrations.WithLabelValues(strconv.Itoa(m.version), "failed").Inc()
+			return
+		}
+		tagMigrations.WithLabelValues(strconv.Itoa(m.version), "migrated").Inc()
+		lv.Tags = append(slices.DeleteFunc(lv.Tags, func(tag string) bool { return tag == volume.SchemaTag(current) }), append(tags, volume.SchemaTag(m.version))...)
+		current = m.version
+	}
+}
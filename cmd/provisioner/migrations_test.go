@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d has version %d, want %d", i, m.version, i+1)
+		}
+	}
+	if last := migrations[len(migrations)-1].version; last != volume.SchemaVersion {
+		t.Errorf("last migration has version %d, want schema version %d", last, volume.SchemaVersion)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	dir := t.TempDir()
+	fsPath := filepath.Join(dir, "pvc-fs")
+	blockPath := filepath.Join(dir, "pvc-block")
+	if err := os.Mkdir(fsPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		version   int
+		tags      []string
+		mountPath string
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "v1 filesystem of csi-lvm v0.4.x",
+			version:   1,
+			mountPath: fsPath,
+			want:      []string{lvTag, "isBlock=false"},
+		},
+		{
+			name:      "v1 block volume of csi-lvm v0.4.x",
+			version:   1,
+			mountPath: blockPath,
+			want:      []string{lvTag, "isBlock=true"},
+		},
+		{
+			name:      "v1 keeps an existing isBlock tag",
+			version:   1,
+			tags:      []string{"isBlock=true"},
+			mountPath: filepath.Join(dir, "missing"),
+			want:      []string{lvTag},
+		},
+		{
+			name:      "v1 without mountpoint",
+			version:   1,
+			mountPath: filepath.Join(dir, "missing"),
+			wantErr:   true,
+		},
+		{
+			name:    "v2 adds the default fsck policy",
+			version: 2,
+			tags:    []string{lvTag, "isBlock=false"},
+			want:    []string{fsckTagPrefix + fsckPreen},
+		},
+		{
+			name:    "v2 keeps the fsck policy",
+			version: 2,
+			tags:    []string{lvTag, "isBlock=false", fsckTagPrefix + fsckAlways},
+		},
+		{
+			name:    "v2 skips block volumes",
+			version: 2,
+			tags:    []string{lvTag, "isBlock=true"},
+		},
+		{
+			name:    "v3 adds the filesystem type",
+			version: 3,
+			tags:    []string{lvTag, "isBlock=false"},
+			want:    []string{volume.FSTypeTag("ext4")},
+		},
+		{
+			name:    "v3 skips block volumes",
+			version: 3,
+			tags:    []string{lvTag, "isBlock=true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := migrations[tt.version-1]
+			lv := &lvm.LV{Name: "pvc-1", Tags: tt.tags}
+			got, err := m.migrate(lv, tt.mountPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("migrate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("migrate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	orphanVolume     = "volume"
+	orphanMountpoint = "mountpoint"
+
+	// clusterLostKey is reported once if orphans are kept because no persistent volume exists
+	clusterLostKey = "cluster-lost"
+
+	flagGracePeriod = "grace-period"
+	flagDryRun      = "dry-run"
+)
+
+// orphan is a logical volume created by csi-lvm or an entry in the mount directory without a persistent volume
+type orphan struct {
+	kind string
+	name string
+	// since is the creation time of the logical volume or the modification time of the mountpoint
+	since time.Time
+	// retained volumes belonged to a persistent volume with the retain reclaim policy
+	retained bool
+	// owner is the claim of a volume, empty if unknown
+	owner string
+}
+
+func (o orphan) String() string {
+	if o.owner != "" {
+		return fmt.Sprintf("%s %s of claim %s", o.kind, o.name, o.owner)
+	}
+	return fmt.Sprintf("%s %s", o.kind, o.name)
+}
+
+// pvExistsFunc returns true if a persistent volume with the given name exists
+type pvExistsFunc func(ctx context.Context, name string) (bool, error)
+
+// anyPVFunc returns true if any persistent volume exists in the cluster
+type anyPVFunc func(ctx context.Context) (bool, error)
+
+// clusterLost returns true if orphaned volumes exist but no persistent volume at all, e.g. after the loss of the cluster.
+// The volumes must be recovered with recoverpvs then, they are never removed.
+func clusterLost(ctx context.Context, orphans []orphan, anyPV anyPVFunc) (bool, error) {
+	volumes := slices.ContainsFunc(orphans, func(o orphan) bool { return o.kind == orphanVolume })
+	if !volumes {
+		return false, nil
+	}
+	exists, err := anyPV(ctx)
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+func cleanOrphansCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "cleanorphans",
+		Usage: "remove logical volumes and mountpoints without a persistent volume",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+				Value: "csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:    flagDirectory,
+				Usage:   "Required. the name of the directory the lvs are mounted",
+				EnvVars: []string{envDirectory},
+				Value:   "/tmp/csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Optional. the name of the node to emit events for",
+				EnvVars: []string{envNodeName},
+			},
+			&cli.DurationFlag{
+				Name:  flagGracePeriod,
+				Usage: "Optional. only remove orphans older than this, volumes are created before their persistent volume",
+				Value: time.Hour,
+			},
+			&cli.BoolFlag{
+				Name:  flagDryRun,
+				Usage: "Optional. only list the orphans",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			vgName := c.String(flagVGName)
+			if vgName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagVGName)
+			}
+			dirName := c.String(flagDirectory)
+			if dirName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagDirectory)
+			}
+			client, err := newKubeClient()
+			if err != nil {
+				return fmt.Errorf("persistent volumes are required to find orphans: %w", err)
+			}
+			recorder := newEventRecorder(c.String(flagNodeName))
+			pvExists := func(ctx context.Context, name string) (bool, error) {
+				_, err := client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+				if k8serror.IsNotFound(err) {
+					return false, nil
+				}
+				return err == nil, err
+			}
+			anyPV := func(ctx context.Context) (bool, error) {
+				pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{Limit: 1})
+				if err != nil {
+					return false, err
+				}
+				return len(pvs.Items) > 0, nil
+			}
+			orphans, err := findOrphans(c.Context, vgName, dirName, pvExists)
+			if err != nil {
+				klog.Fatalf("Error finding orphans: %v", err)
+				return err
+			}
+			lost, err := clusterLost(c.Context, orphans, anyPV)
+			if err != nil {
+				klog.Fatalf("Error listing persistent volumes: %v", err)
+				return err
+			}
+			if lost && !c.Bool(flagDryRun) {
+				err := fmt.Errorf("no persistent volume exists in the cluster, orphaned volumes are not removed, recover them with recoverpvs")
+				klog.Fatalf("Error removing orphans: %v", err)
+				return err
+			}
+			for _, o := range orphans {
+				age := time.Since(o.since).Round(time.Second)
+				if c.Bool(flagDryRun) || age < c.Duration(flagGracePeriod) {
+					fmt.Printf("%s orphaned since %s\n", o, age)
+					continue
+				}
+				err := removeOrphan(c.Context, recorder, vgName, dirName, o, pvExists)
+				if err != nil {
+					klog.Errorf("unable to remove %s: %v", o, err)
+					continue
+				}
+				fmt.Printf("%s removed\n", o)
+			}
+			return nil
+		},
+	}
+}
+
+// findOrphans returns logical volumes tagged by csi-lvm and entries of the mount directory which have no persistent volume
+func findOrphans(ctx context.Context, vgName, dirName string, pvExists pvExistsFunc) ([]orphan, error) {
+	var lvs []lvm.LV
+	if vgExists(vgName) {
+		var err error
+		lvs, err = lvm.LVs(ctx, vgName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list logical volumes of vg %s err:%w", vgName, err)
+		}
+	}
+	return orphansOf(ctx, lvs, dirName, pvExists)
+}
+
+// orphansOf returns the given logical volumes tagged by csi-lvm and the entries of the mount directory without persistent volume
+func orphansOf(ctx context.Context, lvs []lvm.LV, dirName string, pvExists pvExistsFunc) ([]orphan, error) {
+	var result []orphan
+	lvNames := map[string]bool{}
+	for _, lv := range lvs {
+		lvNames[lv.Name] = true
+		if !lv.HasTag(lvTag) {
+			continue
+		}
+		exists, err := pvExists(ctx, lv.Name)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		// without a creation time the grace period starts now
+		o := orphan{kind: orphanVolume, name: lv.Name, since: time.Now()}
+		metadata, err := volume.ParseTags(lv.Tags)
+		o.retained = err == nil && metadata.ReclaimPolicy == v1.PersistentVolumeReclaimRetain
+		o.owner = volume.Owner(lv.Tags)
+		if !lv.Time.IsZero() {
+			o.since = lv.Time
+		}
+		result = append(result, o)
+	}
+
+	entries, err := os.ReadDir(dirName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read mount directory %s err:%w", dirName, err)
+	}
+	for _, e := range entries {
+		if lvNames[e.Name()] {
+			continue
+		}
+		exists, err := pvExists(ctx, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		o := orphan{kind: orphanMountpoint, name: e.Name(), since: time.Now()}
+		info, err := e.Info()
+		if err == nil {
+			o.since = info.ModTime()
+		}
+		result = append(result, o)
+	}
+	return result, nil
+}
+
+// removeOrphan removes an orphaned logical volume with its mountpoint or an orphaned mountpoint.
+// The persistent volume is looked up again right before, mountpoints with data are never removed.
+func removeOrphan(ctx context.Context, recorder *eventRecorder, vgName, dirName string, o orphan, pvExists pvExistsFunc) error {
+	exists, err := pvExists(ctx, o.name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("persistent volume %s exists", o.name)
+	}
+	mountPath := path.Join(dirName, o.name)
+	switch o.kind {
+	case orphanVolume:
+		err := umountLV(o.name, vgName, dirName)
+		if err != nil {
+			return err
+		}
+		err = lvm.RemoveLV(ctx, vgName, o.name)
+		if err != nil {
+			return fmt.Errorf("unable to delete lv: %w", err)
+		}
+	case orphanMountpoint:
+		mounted, err := isMountpoint(mountPath)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			out, err := exec.Command("umount", mountPath).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("unable to umount %s:%s err:%w", mountPath, strings.TrimSpace(string(out)), err)
+			}
+		}
+		if written := writtenToMountpoint(mountPath); len(written) > 0 {
+			return fmt.Errorf("mountpoint %s contains data: %s", mountPath, strings.Join(written, ","))
+		}
+		unprotectMountpoint(mountPath)
+		err = os.Remove(mountPath)
+		if err != nil {
+			return err
+		}
+	}
+	orphansRemoved.WithLabelValues(o.kind).Inc()
+	recorder.nodeEvent(ctx, v1.EventTypeNormal, "OrphanRemoved", "orphaned %s removed", o)
+	return nil
+}
+
+// orphanCollector reports orphans of the reviver and removes them after the grace period if enabled
+type orphanCollector struct {
+	recorder    *eventRecorder
+	vgName      string
+	dirName     string
+	gracePeriod time.Duration
+	remove      bool
+	pvExists    pvExistsFunc
+	anyPV       anyPVFunc
+	// reported remembers orphans which were already reported as event
+	reported map[string]bool
+}
+
+func (oc *orphanCollector) collect(ctx context.Context) {
+	if oc.pvExists == nil {
+		return
+	}
+	orphans, err := findOrphans(ctx, oc.vgName, oc.dirName, oc.pvExists)
+	if err != nil {
+		klog.Errorf("unable to find orphans: %v", err)
+		return
+	}
+	remove := oc.remove
+	if remove {
+		lost, err := clusterLost(ctx, orphans, oc.anyPV)
+		if err != nil {
+			klog.Errorf("unable to list persistent volumes, orphans are not removed: %v", err)
+			remove = false
+		} else if lost {
+			if !oc.reported[clusterLostKey] {
+				oc.reported[clusterLostKey] = true
+				oc.recorder.nodeEvent(ctx, v1.EventTypeWarning, "OrphansKept", "no persistent volume exists in the cluster, orphaned volumes are not removed, recover them with recoverpvs")
+			}
+			remove = false
+		}
+	}
+	counts := map[string]int{orphanVolume: 0, orphanMountpoint: 0}
+	current := map[string]bool{}
+	for _, o := range orphans {
+		age := time.Since(o.since)
+		// retained volumes are only removed explicitly, they may be recovered after the loss of the cluster
+		if remove && age >= oc.gracePeriod && !o.retained {
+			err := removeOrphan(ctx, oc.recorder, oc.vgName, oc.dirName, o, oc.pvExists)
+			if err == nil {
+				continue
+			}
+			klog.Errorf("unable to remove %s: %v", o, err)
+		}
+		counts[o.kind]++
+		current[o.String()] = true
+		if age < oc.gracePeriod || oc.reported[o.String()] {
+			continue
+		}
+		oc.reported[o.String()] = true
+		oc.recorder.nodeEvent(ctx, v1.EventTypeWarning, "OrphanFound", "%s has no persistent volume since %s, automatic removal:%t", o, age.Round(time.Minute), oc.remove)
+	}
+	for kind, count := range counts {
+		orphanCount.WithLabelValues(kind).Set(float64(count))
+	}
+	if remove {
+		delete(oc.reported, clusterLostKey)
+	}
+	for name := range oc.reported {
+		if name != clusterLostKey && !current[name] {
+			delete(oc.reported, name)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+)
+
+func TestOrphansOf(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	retainedTags := []string{lvTag, "pvc.namespace=default", "pvc.name=data", "accessmodes=ReadWriteOnce", "volumemode=Filesystem", "reclaimpolicy=Retain", "capacity=1Gi"}
+	lvs := []lvm.LV{
+		{Name: "pvc-bound", Tags: []string{lvTag}, Time: created},
+		{Name: "pvc-retained", Tags: retainedTags, Time: created},
+		{Name: "pvc-deleted", Tags: []string{lvTag, "pvc.namespace=default", "pvc.name=logs", "reclaimpolicy=Delete"}, Time: created},
+		{Name: "foreign", Tags: nil, Time: created},
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"pvc-bound", "pvc-retained", "foreign", "pvc-gone"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pvs := map[string]bool{"pvc-bound": true}
+	pvExists := func(_ context.Context, name string) (bool, error) { return pvs[name], nil }
+
+	orphans, err := orphansOf(context.Background(), lvs, dir, pvExists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, o := range orphans {
+		got = append(got, o.String())
+		switch o.name {
+		case "pvc-retained":
+			if !o.retained || !o.since.Equal(created) {
+				t.Errorf("orphan %s retained = %v since = %s, want retained since %s", o, o.retained, o.since, created)
+			}
+		case "pvc-deleted":
+			if o.retained {
+				t.Errorf("orphan %s is retained, want not retained", o)
+			}
+		}
+	}
+	want := []string{"volume pvc-retained of claim default/data", "volume pvc-deleted of claim default/logs", "mountpoint pvc-gone"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("orphansOf() = %v, want %v", got, want)
+	}
+
+	errLookup := errors.New("api server not reachable")
+	_, err = orphansOf(context.Background(), lvs, dir, func(context.Context, string) (bool, error) { return false, errLookup })
+	if !errors.Is(err, errLookup) {
+		t.Errorf("orphansOf() error = %v, want %v", err, errLookup)
+	}
+}
+
+func TestClusterLost(t *testing.T) {
+	lvOrphan := orphan{kind: orphanVolume, name: "pvc-1"}
+	dirOrphan := orphan{kind: orphanMountpoint, name: "pvc-2"}
+	errList := errors.New("forbidden")
+	tests := []struct {
+		name    string
+		orphans []orphan
+		anyPV   bool
+		err     error
+		want    bool
+		wantErr error
+	}{
+		{name: "no orphans", want: false},
+		{name: "only mountpoints", orphans: []orphan{dirOrphan}, want: false},
+		{name: "orphaned volume with other persistent volumes", orphans: []orphan{lvOrphan}, anyPV: true, want: false},
+		{name: "orphaned volume without any persistent volume", orphans: []orphan{dirOrphan, lvOrphan}, want: true},
+		{name: "persistent volumes can not be listed", orphans: []orphan{lvOrphan}, err: errList, wantErr: errList},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anyPV := func(context.Context) (bool, error) { return tt.anyPV, tt.err }
+			got, err := clusterLost(context.Background(), tt.orphans, anyPV)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("clusterLost() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("clusterLost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
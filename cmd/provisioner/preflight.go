@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// forceDevicesAnnotation on a node lists devices, comma separated, which are added to the volume group
+// even if the preflight check refused them, e.g. after they have been wiped manually.
+// Devices which are the root disk, mounted or part of another volume group are never added.
+const forceDevicesAnnotation = "csi-lvm.metal-stack.io/force-devices"
+
+// deviceCheck is the preflight result of a single device
+type deviceCheck struct {
+	device blockDevice
+	// reason why the device is refused, empty if it is safe to use
+	reason string
+	// overridable is true if the refusal can be overridden with the force-devices annotation
+	overridable bool
+	// forced is true if the device is used despite the refusal
+	forced bool
+}
+
+func (c deviceCheck) usable() bool {
+	return c.reason == "" || c.forced
+}
+
+// preflight classifies the candidate devices and refuses every device which is in use or belongs to something else.
+func preflight(ctx context.Context, recorder *eventRecorder, vgName string, candidates []blockDevice) ([]deviceCheck, error) {
+	root := rootDisk()
+	pvs, err := physicalVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	forced := forcedDevices(ctx, recorder)
+	mounts := nodeMounts()
+
+	var checks []deviceCheck
+	for _, d := range candidates {
+		check := classify(d, root, pvs, vgName, mounts)
+		if check.reason != "" && check.overridable && slices.Contains(forced, d.Path) {
+			check.forced = true
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+func classify(d blockDevice, rootDisk string, pvs map[string]string, vgName string, nodeMounts map[string][]string) deviceCheck {
+	check := deviceCheck{device: d}
+	pvVG, isPV := pvs[d.Path]
+	hasPartitions := false
+	for _, c := range d.Children {
+		if c.Type == "part" {
+			hasPartitions = true
+		}
+	}
+
+	switch {
+	case rootDisk != "" && d.Path == rootDisk:
+		check.reason = "device is the root disk"
+	case d.Type == "part":
+		check.reason = "device is a partition"
+	case len(d.mounts(nodeMounts)) > 0:
+		check.reason = fmt.Sprintf("device is mounted at %s", d.mounts(nodeMounts))
+	case isPV && pvVG == vgName:
+		check.reason = fmt.Sprintf("device is already part of volume group %s", vgName)
+	case isPV && pvVG != "":
+		check.reason = fmt.Sprintf("device is a physical volume of volume group %s", pvVG)
+	case d.PTType != "" || hasPartitions:
+		check.reason = fmt.Sprintf("device carries a %s partition table", d.PTType)
+		check.overridable = true
+	case d.FSType != "" && !isPV:
+		check.reason = fmt.Sprintf("device carries a %s signature", d.FSType)
+		check.overridable = true
+	}
+	return check
+}
+
+// reportPreflight logs the preflight results and emits node events for refused and forced devices
+func reportPreflight(ctx context.Context, recorder *eventRecorder, vgName string, checks []deviceCheck) {
+	for _, c := range checks {
+		switch {
+		case c.forced:
+			recorder.nodeEvent(ctx, v1.EventTypeWarning, "DeviceForced", "device %s is added to volume group %s although %s, forced by annotation %s", c.device.Path, vgName, c.reason, forceDevicesAnnotation)
+		case c.reason != "" && c.overridable:
+			recorder.nodeEvent(ctx, v1.EventTypeWarning, "DeviceRefused", "device %s is not added to volume group %s: %s, add it to annotation %s to use it anyway", c.device.Path, vgName, c.reason, forceDevicesAnnotation)
+		case c.reason != "":
+			recorder.nodeEvent(ctx, v1.EventTypeWarning, "DeviceRefused", "device %s is not added to volume group %s: %s", c.device.Path, vgName, c.reason)
+		default:
+			klog.Infof("device %s passed preflight check", c.device.Path)
+		}
+	}
+}
+
+// prepareDevices returns the usable devices, signatures of forced devices are wiped before.
+func prepareDevices(checks []deviceCheck) ([]string, error) {
+	var result []string
+	for _, c := range checks {
+		if !c.usable() {
+			continue
+		}
+		if c.forced {
+			klog.Warningf("wiping signatures of forced device %s", c.device.Path)
+			cmd := exec.Command("wipefs", "--all", c.device.Path)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				return nil, fmt.Errorf("unable to wipe device %s err:%w output:%s", c.device.Path, err, out)
+			}
+		}
+		result = append(result, c.device.Path)
+	}
+	return result, nil
+}
+
+// forcedDevices returns the devices listed in the force-devices annotation of the node
+func forcedDevices(ctx context.Context, recorder *eventRecorder) []string {
+	node, err := recorder.node(ctx)
+	if err != nil {
+		klog.Infof("unable to read node annotation %s:%v", forceDevicesAnnotation, err)
+		return nil
+	}
+	annotation := node.Annotations[forceDevicesAnnotation]
+	if annotation == "" {
+		return nil
+	}
+	var result []string
+	for _, device := range strings.Split(annotation, ",") {
+		device = strings.TrimSpace(device)
+		if device == "" {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(device)
+		if err == nil {
+			device = resolved
+		}
+		result = append(result, device)
+	}
+	return result
+}
+
+// nodeMounts returns the mountpoints by major:minor of the mount namespaces of the node and of the container,
+// the node is only visible if the pod runs in the pid namespace of the node
+func nodeMounts() map[string][]string {
+	result := map[string][]string{}
+	for _, file := range []string{"/proc/1/mountinfo", "/proc/self/mountinfo"} {
+		f, err := os.Open(file)
+		if err != nil {
+			klog.Errorf("unable to read mounts %s:%v", file, err)
+			continue
+		}
+		mountInfos, err := parseMountInfo(f)
+		f.Close()
+		if err != nil {
+			klog.Errorf("unable to parse mounts %s:%v", file, err)
+			continue
+		}
+		for _, m := range mountInfos {
+			if !slices.Contains(result[m.majorMinor], m.mountPoint) {
+				result[m.majorMinor] = append(result[m.majorMinor], m.mountPoint)
+			}
+		}
+	}
+	return result
+}
+
+// physicalVolumes returns all known physical volumes with the name of their volume group
+func physicalVolumes(ctx context.Context) (map[string]string, error) {
+	result, err := lvm.PVs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list physical volumes err:%w", err)
+	}
+	pvs := map[string]string{}
+	for _, pv := range result {
+		if pv.Name == "" {
+			continue
+		}
+		pvs[pv.Name] = pv.VGName
+	}
+	return pvs, nil
+}
+
+// rootDisk returns the disk which holds the root filesystem of the host as given on the kernel command line
+func rootDisk() string {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		klog.Errorf("unable to read kernel command line:%v", err)
+		return ""
+	}
+	spec := ""
+	for _, param := range strings.Fields(string(cmdline)) {
+		if strings.HasPrefix(param, "root=") {
+			spec = strings.TrimPrefix(param, "root=")
+		}
+	}
+	if spec == "" {
+		klog.Infof("no root device found on kernel command line")
+		return ""
+	}
+
+	device := spec
+	if !strings.HasPrefix(spec, "/dev/") {
+		// UUID=, PARTUUID=, LABEL= and so on
+		out, err := exec.Command("findfs", spec).Output()
+		if err != nil {
+			klog.Errorf("unable to resolve root device %s:%v", spec, err)
+			return ""
+		}
+		device = strings.TrimSpace(string(out))
+	}
+	resolved, err := filepath.EvalSymlinks(device)
+	if err == nil {
+		device = resolved
+	}
+
+	out, err := exec.Command("lsblk", "--noheadings", "--nodeps", "--output", "PKNAME", device).Output()
+	if err != nil {
+		klog.Errorf("unable to lookup disk of root device %s:%v", device, err)
+		return device
+	}
+	parent := strings.TrimSpace(string(out))
+	if parent == "" {
+		return device
+	}
+	return "/dev/" + parent
+}
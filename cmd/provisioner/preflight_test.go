@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	pvs := map[string]string{
+		"/dev/sdc": "csi-lvm",
+		"/dev/sdd": "other",
+		"/dev/sde": "",
+	}
+	nodeMounts := map[string][]string{
+		"8:64": {"/var/lib/data"},
+	}
+	tests := []struct {
+		name        string
+		device      blockDevice
+		reason      string
+		overridable bool
+	}{
+		{
+			name:   "empty disk",
+			device: blockDevice{Path: "/dev/sdb", MajMin: "8:16", Type: "disk"},
+		},
+		{
+			name:   "root disk",
+			device: blockDevice{Path: "/dev/sda", MajMin: "8:0", Type: "disk"},
+			reason: "root disk",
+		},
+		{
+			name:   "partition",
+			device: blockDevice{Path: "/dev/sdb1", MajMin: "8:17", Type: "part"},
+			reason: "partition",
+		},
+		{
+			name:   "mounted in the container",
+			device: blockDevice{Path: "/dev/sdb", MajMin: "8:16", Type: "disk", Mountpoints: []string{"/mnt"}},
+			reason: "mounted at [/mnt]",
+		},
+		{
+			name:   "mounted on the node only",
+			device: blockDevice{Path: "/dev/sde", MajMin: "8:64", Type: "disk", FSType: "ext4", Mountpoints: []string{""}},
+			reason: "mounted at [/var/lib/data]",
+		},
+		{
+			name: "partition mounted on the node",
+			device: blockDevice{Path: "/dev/sde", MajMin: "8:60", Type: "disk", PTType: "gpt", Children: []blockDevice{
+				{Path: "/dev/sde1", MajMin: "8:64", Type: "part"},
+			}},
+			reason: "mounted at [/var/lib/data]",
+		},
+		{
+			name:   "already part of the volume group",
+			device: blockDevice{Path: "/dev/sdc", MajMin: "8:32", Type: "disk", FSType: "LVM2_member"},
+			reason: "already part of volume group csi-lvm",
+		},
+		{
+			name:   "physical volume of another volume group",
+			device: blockDevice{Path: "/dev/sdd", MajMin: "8:48", Type: "disk", FSType: "LVM2_member"},
+			reason: "volume group other",
+		},
+		{
+			name: "partition table",
+			device: blockDevice{Path: "/dev/sdf", MajMin: "8:80", Type: "disk", PTType: "gpt", Children: []blockDevice{
+				{Path: "/dev/sdf1", MajMin: "8:81", Type: "part"},
+			}},
+			reason:      "gpt partition table",
+			overridable: true,
+		},
+		{
+			name:        "filesystem signature",
+			device:      blockDevice{Path: "/dev/sdg", MajMin: "8:96", Type: "disk", FSType: "xfs"},
+			reason:      "xfs signature",
+			overridable: true,
+		},
+		{
+			name:   "physical volume without volume group",
+			device: blockDevice{Path: "/dev/sde", MajMin: "8:65", Type: "disk", FSType: "LVM2_member"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classify(tt.device, "/dev/sda", pvs, "csi-lvm", nodeMounts)
+			if tt.reason == "" {
+				if got.reason != "" {
+					t.Errorf("classify() refused device: %s", got.reason)
+				}
+				return
+			}
+			if !strings.Contains(got.reason, tt.reason) {
+				t.Errorf("classify() reason = %q, want %q", got.reason, tt.reason)
+			}
+			if got.overridable != tt.overridable {
+				t.Errorf("classify() overridable = %v, want %v", got.overridable, tt.overridable)
+			}
+		})
+	}
+}
+
+func TestLsblkOutput(t *testing.T) {
+	out := `{"blockdevices":[{"name":"sdb","path":"/dev/sdb","maj:min":"8:16","size":1000204886016,"rota":true,"tran":"sata","model":"ST1000","serial":"Z1","type":"disk","fstype":null,"pttype":"gpt","mountpoints":[null],
+	  "children":[{"name":"sdb1","path":"/dev/sdb1","maj:min":"8:17","size":1000203837440,"rota":true,"tran":null,"model":null,"serial":null,"type":"part","fstype":"ext4","pttype":"gpt","mountpoints":["/data"]}]}]}`
+	var result lsblkOutput
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.BlockDevices) != 1 {
+		t.Fatalf("got %d devices, want 1", len(result.BlockDevices))
+	}
+	d := result.BlockDevices[0]
+	if d.MajMin != "8:16" || d.Children[0].MajMin != "8:17" {
+		t.Errorf("maj:min = %s %s, want 8:16 8:17", d.MajMin, d.Children[0].MajMin)
+	}
+	mounts := d.mounts(map[string][]string{"8:17": {"/data", "/host/data"}})
+	if strings.Join(mounts, ",") != "/data,/host/data" {
+		t.Errorf("mounts() = %v, want [/data /host/data]", mounts)
+	}
+}
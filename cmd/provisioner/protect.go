@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// protectMountpoint makes the directory or file a logical volume is mounted on immutable,
+// so pods can not write to the root filesystem of the node if the volume is not mounted.
+// It must only be called while nothing is mounted on the path, otherwise the mounted filesystem is changed.
+func protectMountpoint(mountPath string) error {
+	out, err := exec.Command("chattr", "+i", mountPath).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	klog.Warningf("unable to make %s immutable, e.g. not supported by the filesystem, make it read-only instead:%s %v", mountPath, strings.TrimSpace(string(out)), err)
+	// a read-only mode does not stop privileged pods, but all others
+	chmodErr := os.Chmod(mountPath, 0555)
+	if chmodErr != nil {
+		return fmt.Errorf("unable to protect mountpoint %s err:%w", mountPath, chmodErr)
+	}
+	return nil
+}
+
+// unprotectMountpoint reverts protectMountpoint, it must only be called after the volume was unmounted
+func unprotectMountpoint(mountPath string) {
+	out, err := exec.Command("chattr", "-i", mountPath).CombinedOutput()
+	if err != nil {
+		klog.Infof("unable to remove immutable attribute of %s:%s %v", mountPath, strings.TrimSpace(string(out)), err)
+	}
+}
+
+// isMountpoint returns true if something is mounted on the given path
+func isMountpoint(mountPath string) (bool, error) {
+	mountInfos, err := mounts()
+	if err != nil {
+		return false, err
+	}
+	_, ok := mountInfos[mountPath]
+	return ok, nil
+}
+
+// prepareMountpoint creates the protected directory or file for a logical volume if nothing is mounted yet
+func prepareMountpoint(mountPath string, blockMode bool) error {
+	mounted, err := isMountpoint(mountPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+	_, err = os.Stat(mountPath)
+	switch {
+	case os.IsNotExist(err) && blockMode:
+		f, err := os.Create(mountPath)
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		err = os.MkdirAll(mountPath, 0777)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+	return protectMountpoint(mountPath)
+}
+
+// writtenToMountpoint returns the entries written into the directory of an unmounted filesystem volume
+func writtenToMountpoint(mountPath string) []string {
+	entries, err := os.ReadDir(mountPath)
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, e := range entries {
+		result = append(result, e.Name())
+	}
+	return result
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// degraded returns why the raid logical volume is degraded, or an empty string if it is healthy
+func degraded(lv *lvm.LV) string {
+	if lv.Health != "" {
+		return lv.Health
+	}
+	// the 9th attribute character is the volume health
+	if len(lv.Attr) >= 9 {
+		switch lv.Attr[8] {
+		case 'p':
+			return "partial"
+		case 'r':
+			return "refresh needed"
+		case 'm':
+			return "mismatches exist"
+		}
+	}
+	return ""
+}
+
+// raidLVs returns all raid logical volumes of the volumegroup
+func raidLVs(ctx context.Context, vgName string) ([]lvm.LV, error) {
+	lvs, err := lvm.LVs(ctx, vgName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list raid lvs of vg %s err:%w", vgName, err)
+	}
+	var result []lvm.LV
+	for _, lv := range lvs {
+		if strings.HasPrefix(lv.SegType, "raid") {
+			result = append(result, lv)
+		}
+	}
+	return result, nil
+}
+
+const (
+	// repairBackoff is the first delay before a failed repair is retried in an unchanged volume group, it doubles up to maxRepairBackoff
+	repairBackoff    = 5 * time.Minute
+	maxRepairBackoff = 24 * time.Hour
+)
+
+// raidMonitor checks the health of all raid logical volumes and optionally repairs degraded ones
+type raidMonitor struct {
+	recorder *eventRecorder
+	vgName   string
+	repair   bool
+	// degraded remembers the reported reason per volume to emit events only on changes
+	degraded map[string]string
+	// failed remembers the failed repairs per volume, e.g. if there is no free space for a replacement leg
+	failed map[string]repairFailure
+}
+
+// repairFailure is a failed repair of a volume, it is retried if the volume group changed or after the backoff
+type repairFailure struct {
+	message string
+	// vg is the state of the volume group when the repair failed
+	vg      string
+	backoff time.Duration
+	next    time.Time
+}
+
+func newRaidMonitor(recorder *eventRecorder, vgName string, repair bool) *raidMonitor {
+	return &raidMonitor{
+		recorder: recorder,
+		vgName:   vgName,
+		repair:   repair,
+		degraded: map[string]string{},
+		failed:   map[string]repairFailure{},
+	}
+}
+
+func (m *raidMonitor) check(ctx context.Context) {
+	lvs, err := raidLVs(ctx, m.vgName)
+	if err != nil {
+		klog.Errorf("unable to check raid health: %v", err)
+		return
+	}
+	for name := range m.failed {
+		if !slices.ContainsFunc(lvs, func(lv lvm.LV) bool { return lv.Name == name }) {
+			delete(m.failed, name)
+		}
+	}
+	for _, lv := range lvs {
+		reason := degraded(&lv)
+		if reason == "" {
+			delete(m.failed, lv.Name)
+			if _, ok := m.degraded[lv.Name]; ok {
+				delete(m.degraded, lv.Name)
+				m.recorder.volumeEvent(ctx, lv.Name, v1.EventTypeNormal, "RaidRecovered", "%s volume is healthy again, sync:%s%%", lv.SegType, lv.SyncPercent)
+				m.recorder.nodeEvent(ctx, v1.EventTypeNormal, "RaidRecovered", "%s volume %s is healthy again", lv.SegType, lv.Name)
+			}
+			continue
+		}
+
+		if m.degraded[lv.Name] != reason {
+			m.degraded[lv.Name] = reason
+			m.recorder.volumeEvent(ctx, lv.Name, v1.EventTypeWarning, "RaidDegraded", "%s volume is degraded: %s, attr:%s sync:%s%%", lv.SegType, reason, lv.Attr, lv.SyncPercent)
+			m.recorder.nodeEvent(ctx, v1.EventTypeWarning, "RaidDegraded", "%s volume %s is degraded: %s, attr:%s sync:%s%%", lv.SegType, lv.Name, reason, lv.Attr, lv.SyncPercent)
+		}
+		if m.repair {
+			m.repairLV(ctx, &lv, reason)
+		}
+	}
+}
+
+// repairLV replaces failed legs with free space of other physical volumes, or refreshes transiently failed legs
+func (m *raidMonitor) repairLV(ctx context.Context, lv *lvm.LV, reason string) {
+	var args []string
+	switch reason {
+	case "partial":
+		args = []string{"lvconvert", "--repair", "--yes", m.vgName + "/" + lv.Name}
+	case "refresh needed":
+		args = []string{"lvchange", "--refresh", m.vgName + "/" + lv.Name}
+	default:
+		return
+	}
+	vg := m.vgState(ctx)
+	now := time.Now()
+	if !m.repairDue(lv.Name, vg, now) {
+		klog.Infof("repair of raid lv %s failed before, retry after %s or a change of the volume group", lv.Name, m.failed[lv.Name].next.Format(time.RFC3339))
+		return
+	}
+	klog.Infof("repair raid command: %s", args)
+	_, err := lvm.Run(ctx, args[0], args[1:]...)
+	if err != nil {
+		if m.repairFailed(lv.Name, vg, err.Error(), now) {
+			m.recorder.volumeEvent(ctx, lv.Name, v1.EventTypeWarning, "RaidRepairFailed", "%v", err)
+		} else {
+			klog.Errorf("repair of raid lv %s failed again: %v", lv.Name, err)
+		}
+		return
+	}
+	delete(m.failed, lv.Name)
+	m.recorder.volumeEvent(ctx, lv.Name, v1.EventTypeNormal, "RaidRepaired", "%s volume repaired with %s", lv.SegType, args[0])
+}
+
+// repairDue returns true if the volume was not repaired before, the volume group changed since the failed repair or its backoff passed
+func (m *raidMonitor) repairDue(lvName, vg string, now time.Time) bool {
+	f, ok := m.failed[lvName]
+	return !ok || f.vg != vg || !now.Before(f.next)
+}
+
+// repairFailed records a failed repair and doubles its backoff, it returns true if the failure is new and must be reported
+func (m *raidMonitor) repairFailed(lvName, vg, message string, now time.Time) bool {
+	f, ok := m.failed[lvName]
+	f.backoff = min(max(2*f.backoff, repairBackoff), maxRepairBackoff)
+	f.next = now.Add(f.backoff)
+	f.vg = vg
+	report := !ok || f.message != message
+	f.message = message
+	m.failed[lvName] = f
+	return report
+}
+
+// vgState returns what changes if devices are added, replaced or missing, empty if unknown
+func (m *raidMonitor) vgState(ctx context.Context) string {
+	vg, err := lvm.LookupVG(ctx, m.vgName)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("size:%d free:%d pvs:%d missing:%d", vg.Size, vg.Free, vg.PVCount, vg.MissingPVCount)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+)
+
+func TestDegraded(t *testing.T) {
+	tests := []struct {
+		name string
+		lv   lvm.LV
+		want string
+	}{
+		{name: "healthy", lv: lvm.LV{Attr: "rwi-aor---"}, want: ""},
+		{name: "health status wins", lv: lvm.LV{Attr: "rwi-aor-p-", Health: "refresh needed"}, want: "refresh needed"},
+		{name: "partial", lv: lvm.LV{Attr: "rwi-aor-p-"}, want: "partial"},
+		{name: "refresh needed", lv: lvm.LV{Attr: "rwi-aor-r-"}, want: "refresh needed"},
+		{name: "mismatches", lv: lvm.LV{Attr: "rwi-aor-m-"}, want: "mismatches exist"},
+		{name: "short attributes", lv: lvm.LV{Attr: "rwi"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := degraded(&tt.lv); got != tt.want {
+				t.Errorf("degraded() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepairBackoff(t *testing.T) {
+	m := newRaidMonitor(nil, "csi-lvm", true)
+	now := time.Now()
+	const vg = "size:100 free:0 pvs:2 missing:1"
+
+	if !m.repairDue("pvc-1", vg, now) {
+		t.Fatal("first repair is not due")
+	}
+	if !m.repairFailed("pvc-1", vg, "insufficient suitable allocatable extents", now) {
+		t.Error("first failure is not reported")
+	}
+
+	tests := []struct {
+		name   string
+		lvName string
+		vg     string
+		at     time.Duration
+		want   bool
+	}{
+		{name: "unchanged volume group", lvName: "pvc-1", vg: vg, at: time.Minute, want: false},
+		{name: "changed volume group", lvName: "pvc-1", vg: "size:200 free:100 pvs:3 missing:1", at: time.Minute, want: true},
+		{name: "backoff passed", lvName: "pvc-1", vg: vg, at: repairBackoff, want: true},
+		{name: "other volume", lvName: "pvc-2", vg: vg, at: 0, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.repairDue(tt.lvName, tt.vg, now.Add(tt.at)); got != tt.want {
+				t.Errorf("repairDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the same failure again is not reported and doubles the backoff
+	if m.repairFailed("pvc-1", vg, "insufficient suitable allocatable extents", now) {
+		t.Error("repeated failure is reported again")
+	}
+	if m.repairDue("pvc-1", vg, now.Add(repairBackoff)) {
+		t.Error("repair is due before the doubled backoff passed")
+	}
+	if !m.repairFailed("pvc-1", vg, "can't get lock", now) {
+		t.Error("other failure is not reported")
+	}
+	for range 20 {
+		m.repairFailed("pvc-1", vg, "can't get lock", now)
+	}
+	if got := m.failed["pvc-1"].backoff; got != maxRepairBackoff {
+		t.Errorf("backoff = %s, want %s", got, maxRepairBackoff)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	keyNode = volume.KeyNode
+	lvTag   = volume.Tag
+)
+
+// mountInfo is a single entry of /proc/self/mountinfo
+type mountInfo struct {
+	majorMinor string
+	root       string
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// mounts returns the mounts of this mount namespace by mountpoint
+func mounts() (map[string]mountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+func parseMountInfo(r io.Reader) (map[string]mountInfo, error) {
+	result := map[string]mountInfo{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		sep := slices.Index(fields, "-")
+		if len(fields) < 5 || sep < 0 || len(fields) < sep+3 {
+			continue
+		}
+		m := mountInfo{
+			majorMinor: fields[2],
+			root:       unescapeMountInfo(fields[3]),
+			mountPoint: unescapeMountInfo(fields[4]),
+			fsType:     fields[sep+1],
+			source:     unescapeMountInfo(fields[sep+2]),
+		}
+		result[m.mountPoint] = m
+	}
+	return result, scanner.Err()
+}
+
+// unescapeMountInfo replaces the octal escapes of space, tab, newline and backslash
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// unknownPVGracePeriod is the age of a logical volume before it is mounted if the persistent volumes are unknown,
+// a younger volume may still be created by createlv
+const unknownPVGracePeriod = 10 * time.Minute
+
+// deleting returns true if the persistent volume is released to be deleted by deletelv
+func deleting(pv *v1.PersistentVolume) bool {
+	if pv.DeletionTimestamp != nil {
+		return true
+	}
+	released := pv.Status.Phase == v1.VolumeReleased || pv.Status.Phase == v1.VolumeFailed
+	return released && pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete
+}
+
+// reconcileResult is the outcome of a single reconciliation, served by the health endpoint
+type reconcileResult struct {
+	Time     time.Time `json:"time"`
+	Volumes  int       `json:"volumes"`
+	Mounted  int       `json:"mounted"`
+	Repaired []string  `json:"repaired,omitempty"`
+	Drift    []string  `json:"drift,omitempty"`
+	// Pending are the volumes created by csi-lvm which are not mounted
+	Pending []string `json:"pending,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// pending records a volume which is not mounted, only volumes created by csi-lvm block the readiness of the node
+func (result *reconcileResult) pending(lv *lvm.LV) {
+	if lv.HasTag(lvTag) {
+		result.Pending = append(result.Pending, lv.Name)
+	}
+}
+
+// reviver keeps the mounts of all logical volumes in sync with the persistent volumes of this node
+type reviver struct {
+	recorder *eventRecorder
+	vgName   string
+	dirName  string
+	interval time.Duration
+	// pvLister is nil without access to the api server
+	pvLister corelisters.PersistentVolumeLister
+	// trigger requests a reconciliation before the next interval
+	trigger chan struct{}
+	// reported remembers drift which was already reported as event
+	reported map[string]bool
+	// taint is nil if the node is not tainted until the volumes are mounted
+	taint *nodeTaint
+
+	mu   sync.Mutex
+	last reconcileResult
+}
+
+func newReviver(ctx context.Context, recorder *eventRecorder, vgName, dirName string, interval time.Duration) *reviver {
+	r := &reviver{
+		recorder: recorder,
+		vgName:   vgName,
+		dirName:  dirName,
+		interval: interval,
+		trigger:  make(chan struct{}, 1),
+		reported: map[string]bool{},
+	}
+	if recorder.client == nil {
+		klog.Info("no access to the api server, persistent volumes are not reconciled")
+		return r
+	}
+	factory := informers.NewSharedInformerFactory(recorder.client, 0)
+	informer := factory.Core().V1().PersistentVolumes()
+	_, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { r.triggerReconcile() },
+		UpdateFunc: func(oldObj, newObj any) { r.triggerReconcile() },
+		DeleteFunc: func(obj any) { r.triggerReconcile() },
+	})
+	if err != nil {
+		klog.Errorf("unable to watch persistent volumes: %v", err)
+		return r
+	}
+	factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	for _, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			klog.Error("unable to list persistent volumes, persistent volumes are not reconciled")
+			return r
+		}
+	}
+	r.pvLister = informer.Lister()
+	return r
+}
+
+func (r *reviver) triggerReconcile() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run reconciles in the configured interval and whenever a persistent volume changes, it never returns
+func (r *reviver) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		result := r.reconcile(ctx)
+		if r.taint != nil {
+			r.taint.reconciled(ctx, result)
+		}
+		select {
+		case <-ticker.C:
+		case <-r.trigger:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// localPVs returns the persistent volumes of this node by name
+func (r *reviver) localPVs() (map[string]*v1.PersistentVolume, error) {
+	pvs, err := r.pvLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]*v1.PersistentVolume{}
+	for _, pv := range pvs {
+		if pv.Spec.Local == nil || path.Dir(pv.Spec.Local.Path) != r.dirName {
+			continue
+		}
+		if volume.Node(pv) != r.recorder.nodeName {
+			continue
+		}
+		result[pv.Name] = pv
+	}
+	return result, nil
+}
+
+// pvExists looks up a persistent volume in the cache, it is nil without access to the api server
+func (r *reviver) pvExists() pvExistsFunc {
+	if r.pvLister == nil {
+		return nil
+	}
+	return func(_ context.Context, name string) (bool, error) {
+		_, err := r.pvLister.Get(name)
+		if k8serror.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
+
+// anyPV returns true if the cache holds a persistent volume, it is nil without access to the api server
+func (r *reviver) anyPV() anyPVFunc {
+	if r.pvLister == nil {
+		return nil
+	}
+	return func(_ context.Context) (bool, error) {
+		pvs, err := r.pvLister.List(labels.Everything())
+		return len(pvs) > 0, err
+	}
+}
+
+// reconcile compares persistent volumes, logical volumes and mounts, mounts missing volumes and reports drift
+func (r *reviver) reconcile(ctx context.Context) reconcileResult {
+	result := reconcileResult{Time: time.Now()}
+	defer func() {
+		r.mu.Lock()
+		r.last = result
+		r.mu.Unlock()
+	}()
+
+	if !vgExists(r.vgName) {
+		klog.Infof("volumegroup: %s not found\n", r.vgName)
+		return result
+	}
+	lvs, err := lvm.LVs(ctx, r.vgName)
+	if err != nil {
+		result.Error = fmt.Sprintf("unable to list existing logicalvolumes:%v", err)
+		klog.Error(result.Error)
+		return result
+	}
+	mountInfos, err := mounts()
+	if err != nil {
+		result.Error = fmt.Sprintf("unable to read mounts:%v", err)
+		klog.Error(result.Error)
+		return result
+	}
+	var pvs map[string]*v1.PersistentVolume
+	if r.pvLister != nil {
+		pvs, err = r.localPVs()
+		if err != nil {
+			result.Error = fmt.Sprintf("unable to list persistent volumes:%v", err)
+			klog.Error(result.Error)
+			return result
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := range lvs {
+		lv := &lvs[i]
+		if lv.Hidden() {
+			// hidden sub volumes of raid volumes
+			continue
+		}
+		seen[lv.Name] = true
+		result.Volumes++
+		targetPath := path.Join(r.dirName, lv.Name)
+		if pvs != nil && pvs[lv.Name] == nil {
+			// e.g. a volume createlv is still creating, it is never mounted by the reviver
+			r.drift(ctx, &result, lv.Name, "", "logical volume %s of claim %q has no persistent volume", lv.Name, volume.Owner(lv.Tags))
+			continue
+		}
+		if pvs != nil && deleting(pvs[lv.Name]) {
+			// deletelv unmounts the volume before it is removed
+			continue
+		}
+		if pvs == nil && time.Since(lv.Time) < unknownPVGracePeriod {
+			klog.Infof("lv %s was created %s ago, it is not mounted without its persistent volume", lv.Name, time.Since(lv.Time).Round(time.Second))
+			continue
+		}
+
+		m, mounted := mountInfos[targetPath]
+		if mounted {
+			if !isBlockLV(lv) && m.majorMinor != fmt.Sprintf("%d:%d", lv.Major, lv.Minor) {
+				result.pending(lv)
+				r.drift(ctx, &result, lv.Name, "VolumeMountMismatch", "%s is mounted from %s %s instead of the logical volume", targetPath, m.source, m.majorMinor)
+				continue
+			}
+			result.Mounted++
+			delete(r.reported, lv.Name)
+			continue
+		}
+
+		klog.Infof("target %s is not mounted. Reviving ...\n", targetPath)
+		if written := writtenToMountpoint(targetPath); len(written) > 0 {
+			r.drift(ctx, &result, lv.Name, "VolumeNotMountpoint", "%s is not a mountpoint, %d entries were written to the root filesystem of the node instead of the volume: %s", targetPath, len(written), strings.Join(written, ","))
+		}
+		if lv.Major < 0 || lv.Minor < 0 {
+			result.pending(lv)
+			r.drift(ctx, &result, lv.Name, "VolumeInactive", "logical volume %s is not active and can not be mounted", lv.Name)
+			continue
+		}
+		if err := mountExistingLV(ctx, r.recorder, lv, r.vgName, r.dirName); err != nil {
+			result.pending(lv)
+			r.drift(ctx, &result, lv.Name, "VolumeMountFailed", "unable to mount %s: %v", targetPath, err)
+			continue
+		}
+		result.Mounted++
+		result.Repaired = append(result.Repaired, lv.Name)
+		delete(r.reported, lv.Name)
+		r.recorder.volumeEvent(ctx, lv.Name, v1.EventTypeNormal, "VolumeRevived", "%s mounted again", targetPath)
+	}
+
+	for name := range pvs {
+		if seen[name] {
+			continue
+		}
+		message := fmt.Sprintf("logical volume %s of persistent volume is missing in volume group %s", name, r.vgName)
+		if written := writtenToMountpoint(path.Join(r.dirName, name)); len(written) > 0 {
+			message += fmt.Sprintf(", %d entries were written to the root filesystem of the node instead: %s", len(written), strings.Join(written, ","))
+		}
+		r.drift(ctx, &result, name, "VolumeMissing", "%s", message)
+	}
+	klog.Infof("reconciled %d volumes, %d mounted, %d repaired, %d drifted", result.Volumes, result.Mounted, len(result.Repaired), len(result.Drift))
+	return result
+}
+
+// drift records a difference which can not be fixed automatically, an event is emitted once per volume if a reason is given
+func (r *reviver) drift(ctx context.Context, result *reconcileResult, lvName, reason, messageFmt string, args ...any) {
+	message := fmt.Sprintf(messageFmt, args...)
+	result.Drift = append(result.Drift, message)
+	if reason == "" || r.reported[lvName] {
+		klog.Warning(message)
+		return
+	}
+	r.reported[lvName] = true
+	r.recorder.volumeEvent(ctx, lvName, v1.EventTypeWarning, reason, "%s", message)
+}
+
+// health serves the result of the last reconciliation, it fails if it failed, is outdated or volumes are not mounted yet
+func (r *reviver) health(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	last := r.last
+	r.mu.Unlock()
+
+	status := http.StatusOK
+	if last.Error != "" || len(last.Pending) > 0 || time.Since(last.Time) > 3*r.interval {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(last)
+	if err != nil {
+		klog.Errorf("unable to write health response: %v", err)
+	}
+}
+
+func isBlockLV(lv *lvm.LV) bool {
+	return lv.HasTag("isBlock=true")
+}
+
+// mountExistingLV mounts an existing logical volume according to its isBlock tag, filesystems are checked before
+func mountExistingLV(ctx context.Context, recorder *eventRecorder, lv *lvm.LV, vgName, dirName string) error {
+	for _, n := range lv.Tags {
+		if n == "isBlock=true" {
+			_, err := bindMountLV(lv.Name, vgName, dirName)
+			return err
+		} else if n == "isBlock=false" {
+			readOnly, err := checkFilesystem(ctx, recorder, vgName, lv)
+			if err != nil {
+				return err
+			}
+			_, err = mountLV(lv.Name, vgName, dirName, readOnly)
+			return err
+		}
+	}
+	return fmt.Errorf("logical volume %s has no isBlock tag", lv.Name)
+}
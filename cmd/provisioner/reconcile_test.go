@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		mountinfo string
+		want      map[string]mountInfo
+	}{
+		{
+			name: "filesystem and block volume",
+			mountinfo: `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+613 22 253:1 / /tmp/csi-lvm/pvc-1 rw,relatime shared:300 - ext4 /dev/mapper/csi--lvm-pvc--1 rw
+614 22 0:5 /mapper/csi--lvm-pvc--2 /tmp/csi-lvm/pvc-2 rw,nosuid - devtmpfs udev rw,size=8000000k
+`,
+			want: map[string]mountInfo{
+				"/": {majorMinor: "8:1", root: "/", mountPoint: "/", fsType: "ext4", source: "/dev/sda1"},
+				"/tmp/csi-lvm/pvc-1": {
+					majorMinor: "253:1", root: "/", mountPoint: "/tmp/csi-lvm/pvc-1", fsType: "ext4", source: "/dev/mapper/csi--lvm-pvc--1",
+				},
+				"/tmp/csi-lvm/pvc-2": {
+					majorMinor: "0:5", root: "/mapper/csi--lvm-pvc--2", mountPoint: "/tmp/csi-lvm/pvc-2", fsType: "devtmpfs", source: "udev",
+				},
+			},
+		},
+		{
+			name:      "no optional fields",
+			mountinfo: "36 35 98:0 /mnt1 /mnt2 rw,noatime - ext3 /dev/root rw,errors=continue\n",
+			want: map[string]mountInfo{
+				"/mnt2": {majorMinor: "98:0", root: "/mnt1", mountPoint: "/mnt2", fsType: "ext3", source: "/dev/root"},
+			},
+		},
+		{
+			name:      "escaped mountpoint",
+			mountinfo: `40 22 253:2 / /tmp/csi-lvm/my\040volume\134x rw - ext4 /dev/mapper/x rw` + "\n",
+			want: map[string]mountInfo{
+				`/tmp/csi-lvm/my volume\x`: {majorMinor: "253:2", root: "/", mountPoint: `/tmp/csi-lvm/my volume\x`, fsType: "ext4", source: "/dev/mapper/x"},
+			},
+		},
+		{
+			name:      "malformed lines are skipped",
+			mountinfo: "garbage\n41 22 253:3 / /a rw shared:1\n",
+			want:      map[string]mountInfo{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMountInfo(strings.NewReader(tt.mountinfo))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMountInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const flagProvisionerName = "provisioner-name"
+
+func recoverPVsCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "recoverpvs",
+		Usage: "recreate missing persistent volumes from the tags of the logical volumes, e.g. after the loss of the cluster",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+				Value: "csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:    flagDirectory,
+				Usage:   "Required. the name of the directory the lvs are mounted",
+				EnvVars: []string{envDirectory},
+				Value:   "/tmp/csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Required. the name of the node the persistent volumes are bound to",
+				EnvVars: []string{envNodeName},
+			},
+			&cli.StringFlag{
+				Name:  flagProvisionerName,
+				Usage: "Optional. the provisioner of the persistent volumes if their storageclass does not exist",
+				Value: "metal-stack.io/csi-lvm",
+			},
+			&cli.BoolFlag{
+				Name:  flagDryRun,
+				Usage: "Optional. only list the persistent volumes which would be created",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			vgName := c.String(flagVGName)
+			if vgName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagVGName)
+			}
+			dirName := c.String(flagDirectory)
+			if dirName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagDirectory)
+			}
+			nodeName := c.String(flagNodeName)
+			if nodeName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagNodeName)
+			}
+			recorder := newEventRecorder(nodeName)
+			if recorder.client == nil {
+				return fmt.Errorf("no access to the api server")
+			}
+			if err := recoverPVs(c.Context, recorder, vgName, dirName, c.String(flagProvisionerName), c.Bool(flagDryRun)); err != nil {
+				klog.Fatalf("Error recovering pvs: %v", err)
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// taggedLVs returns the tags of all logical volumes created by csi-lvm by name
+func taggedLVs(ctx context.Context, vgName string) (map[string][]string, error) {
+	lvs, err := lvm.LVs(ctx, vgName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list logical volumes of vg %s err:%w", vgName, err)
+	}
+	result := map[string][]string{}
+	for _, lv := range lvs {
+		if lv.HasTag(lvTag) {
+			result[lv.Name] = lv.Tags
+		}
+	}
+	return result, nil
+}
+
+// recoverPVs creates the missing persistent volumes of all logical volumes with complete metadata tags,
+// pre-bound to their original claim so a recreated claim of the same name gets its data back
+func recoverPVs(ctx context.Context, recorder *eventRecorder, vgName, dirName, provisionerName string, dryRun bool) error {
+	lvs, err := taggedLVs(ctx, vgName)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(lvs))
+	for name := range lvs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	pvs := recorder.client.CoreV1().PersistentVolumes()
+	for _, name := range names {
+		_, err := pvs.Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			fmt.Printf("%s: persistent volume exists\n", name)
+			continue
+		}
+		if !k8serror.IsNotFound(err) {
+			return err
+		}
+		metadata, err := volume.ParseTags(lvs[name])
+		if err != nil {
+			fmt.Printf("%s: skipped, %v\n", name, err)
+			continue
+		}
+
+		pv := preBoundPV(ctx, recorder, name, dirName, metadata, provisionerName)
+		claim := metadata.PVCNamespace + "/" + metadata.PVCName
+		if dryRun {
+			fmt.Printf("%s: would be recreated for claim %s\n", name, claim)
+			continue
+		}
+		_, err = pvs.Create(ctx, pv, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to create persistent volume %s err:%w", name, err)
+		}
+		fmt.Printf("%s: recreated for claim %s\n", name, claim)
+		recorder.volumeEvent(ctx, name, v1.EventTypeNormal, "VolumeRecovered", "persistent volume recreated from logical volume tags for claim %s", claim)
+	}
+	return nil
+}
+
+// preBoundPV returns a persistent volume like the controller provisions it, bound to the claim of the metadata
+func preBoundPV(ctx context.Context, recorder *eventRecorder, name, dirName string, metadata volume.Metadata, defaultProvisioner string) *v1.PersistentVolume {
+	pv := volume.PersistentVolume(name, path.Join(dirName, name), recorder.nodeName, metadata)
+	pv.Spec.StorageClassName = metadata.StorageClass
+	pv.Spec.ClaimRef = &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  metadata.PVCNamespace,
+		Name:       metadata.PVCName,
+	}
+	pv.Annotations[volume.ProvisionedByAnnotation] = storageClassProvisioner(ctx, recorder.client, metadata.StorageClass, defaultProvisioner)
+	return pv
+}
+
+// storageClassProvisioner returns the provisioner of the storageclass, the given default if it does not exist
+func storageClassProvisioner(ctx context.Context, client clientset.Interface, storageClass, defaultProvisioner string) string {
+	sc, err := client.StorageV1().StorageClasses().Get(ctx, storageClass, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("unable to get storageclass %s, assuming provisioner %s: %v", storageClass, defaultProvisioner, err)
+		return defaultProvisioner
+	}
+	return sc.Provisioner
+}
@@ -2,25 +2,39 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
-	"os/exec"
-	"strconv"
+	"strings"
 	"time"
 
-	"github.com/google/lvmd/commands"
+	"github.com/metal-stack/csi-lvm/internal/lvm"
 	"github.com/urfave/cli/v2"
 	"k8s.io/klog/v2"
 )
 
 var (
-	envDirectory = "CSI_LVM_MOUNTPOINT"
+	envDirectory  = "CSI_LVM_MOUNTPOINT"
+	envAutoExtend = "CSI_LVM_AUTO_EXTEND"
+	envRaidRepair = "CSI_LVM_RAID_AUTO_REPAIR"
+	envDegraded   = "CSI_LVM_DEGRADED_ACTIVATION"
+	envScrub      = "CSI_LVM_SCRUB_INTERVAL"
+	envScrubRate  = "CSI_LVM_SCRUB_RATE"
+	envScrubFix   = "CSI_LVM_SCRUB_REPAIR"
+	envMetrics    = "CSI_LVM_METRICS_ADDRESS"
+	envReconcile  = "CSI_LVM_RECONCILE_INTERVAL"
+	envTaint      = "CSI_LVM_NODE_TAINT"
+	envTaintTime  = "CSI_LVM_NODE_TAINT_TIMEOUT"
+	envTaintRule  = "CSI_LVM_NODE_TAINT_TIMEOUT_POLICY"
+	envOrphanTime = "CSI_LVM_ORPHAN_GRACE_PERIOD"
+	envOrphanGC   = "CSI_LVM_ORPHAN_CLEANUP"
 )
 
 func reviveLVsCmd() *cli.Command {
 	return &cli.Command{
 		Name: "revivelvs",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:  flagVGName,
 				Usage: "Required. the name of the volumegroup",
@@ -32,39 +46,227 @@ func reviveLVsCmd() *cli.Command {
 				EnvVars: []string{envDirectory},
 				Value:   "/tmp/csi-lvm",
 			},
-		},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Optional. the name of the node to emit events for",
+				EnvVars: []string{envNodeName},
+			},
+			&cli.BoolFlag{
+				Name:    flagAutoExtend,
+				Usage:   "Optional. extend the volumegroup with new devices matching the devices pattern",
+				EnvVars: []string{envAutoExtend},
+				Value:   true,
+			},
+			&cli.BoolFlag{
+				Name:    flagRaidRepair,
+				Usage:   "Optional. repair degraded raid volumes with lvconvert --repair onto free space of other physical volumes",
+				EnvVars: []string{envRaidRepair},
+			},
+			&cli.BoolFlag{
+				Name:    flagDegraded,
+				Usage:   "Optional. activate redundant volumes with missing legs in degraded mode",
+				EnvVars: []string{envDegraded},
+			},
+			&cli.DurationFlag{
+				Name:    flagScrubInterval,
+				Usage:   "Optional. scrub every raid volume with lvchange --syncaction check in this interval, disabled if 0",
+				EnvVars: []string{envScrub},
+			},
+			&cli.StringFlag{
+				Name:    flagScrubRate,
+				Usage:   "Optional. limit the rate of scrubs per device in lvchange --maxrecoveryrate format, e.g. 50M",
+				EnvVars: []string{envScrubRate},
+			},
+			&cli.BoolFlag{
+				Name:    flagScrubRepair,
+				Usage:   "Optional. repair mismatches found by a scrub with lvchange --syncaction repair",
+				EnvVars: []string{envScrubFix},
+			},
+			&cli.StringFlag{
+				Name:    flagMetricsAddress,
+				Usage:   "Optional. the address to serve prometheus metrics and the health of the last reconciliation on, disabled if empty",
+				EnvVars: []string{envMetrics},
+				Value:   ":9090",
+			},
+			&cli.DurationFlag{
+				Name:    flagReconcileInterval,
+				Usage:   "Optional. the interval to reconcile the mounts of all volumes",
+				EnvVars: []string{envReconcile},
+				Value:   time.Minute,
+			},
+			&cli.BoolFlag{
+				Name:    flagTaint,
+				Usage:   "Optional. taint the node with " + notReadyTaintKey + ":NoExecute until all volumes are mounted",
+				EnvVars: []string{envTaint},
+			},
+			&cli.DurationFlag{
+				Name:    flagTaintTimeout,
+				Usage:   "Optional. the time after which the timeout policy applies if not all volumes are mounted, never if 0",
+				EnvVars: []string{envTaintTime},
+				Value:   10 * time.Minute,
+			},
+			&cli.StringFlag{
+				Name:    flagTaintPolicy,
+				Usage:   "Optional. keep or remove the taint after the timeout",
+				EnvVars: []string{envTaintRule},
+				Value:   taintPolicyKeep,
+			},
+			&cli.DurationFlag{
+				Name:    flagOrphanGracePeriod,
+				Usage:   "Optional. report logical volumes and mountpoints without a persistent volume after this period",
+				EnvVars: []string{envOrphanTime},
+				Value:   24 * time.Hour,
+			},
+			&cli.BoolFlag{
+				Name:    flagOrphanCleanup,
+				Usage:   "Optional. remove logical volumes and mountpoints without a persistent volume after the grace period",
+				EnvVars: []string{envOrphanGC},
+			},
+			&cli.BoolFlag{
+				Name:  flagOnce,
+				Usage: "Optional. revive and mount all logical volumes once, print the result as json and exit, e.g. for a manual recovery",
+			},
+		}, deviceSelectorFlags()...),
 		Action: func(c *cli.Context) error {
-			if err := reviveLVs(c); err != nil {
+			recorder := newEventRecorder(c.String(flagNodeName))
+			var taint *nodeTaint
+			if c.Bool(flagTaint) {
+				var err error
+				taint, err = newNodeTaint(recorder, c.Duration(flagTaintTimeout), c.String(flagTaintPolicy))
+				if err != nil {
+					klog.Fatalf("Error tainting node: %v", err)
+					return err
+				}
+			}
+			if err := reviveLVs(c, recorder); err != nil {
 				klog.Fatalf("Error reviving logical volumes: %v", err)
 				return err
 			}
-			// stay alive
-			for {
-				logStatus()
-				time.Sleep(5 * time.Minute)
+			if taint != nil {
+				// the volumegroup is activated before, it is not found after a reboot otherwise
+				taint.taint(c.Context, c.String(flagVGName), c.String(flagDirectory))
+			}
+			vgName := c.String(flagVGName)
+			extender := vgExtenderFromContext(c, recorder)
+			raid := newRaidMonitor(recorder, vgName, c.Bool(flagRaidRepair))
+			var scrub *scrubber
+			if interval := c.Duration(flagScrubInterval); interval > 0 {
+				scrub = newScrubber(recorder, vgName, interval, c.String(flagScrubRate), c.Bool(flagScrubRepair))
+			}
+			r := newReviver(c.Context, recorder, vgName, c.String(flagDirectory), c.Duration(flagReconcileInterval))
+			r.taint = taint
+			if c.Bool(flagOnce) {
+				if err := reviveOnce(c.Context, r); err != nil {
+					klog.Fatalf("Error reviving logical volumes: %v", err)
+					return err
+				}
+				return nil
 			}
+			orphans := &orphanCollector{
+				recorder:    recorder,
+				vgName:      vgName,
+				dirName:     c.String(flagDirectory),
+				gracePeriod: c.Duration(flagOrphanGracePeriod),
+				remove:      c.Bool(flagOrphanCleanup),
+				pvExists:    r.pvExists(),
+				anyPV:       r.anyPV(),
+				reported:    map[string]bool{},
+			}
+			devices := &deviceMaintainer{recorder: recorder, vgName: vgName}
+			maintenance := func() {
+				logStatus(c.Context)
+				raid.check(c.Context)
+				if scrub != nil {
+					scrub.scrub(c.Context)
+				}
+				devices.start(c.Context)
+				if extender != nil {
+					err := extender.extend(c.Context)
+					if err != nil {
+						klog.Errorf("unable to extend volumegroup: %v", err)
+					}
+				}
+				orphans.collect(c.Context)
+			}
+
+			http.HandleFunc("/healthz", r.health)
+			serveMetrics(c.String(flagMetricsAddress))
+			// stay alive
+			go runMaintenance(c.Context, maintenance, 5*time.Minute)
+			r.run(c.Context)
+			return nil
 		},
 	}
 }
 
+// runMaintenance runs the maintenance right away and then in the given interval until the context is done.
+// It runs apart from the reconciliation, a slow pass must neither delay the mounts nor fail the health check.
+func runMaintenance(ctx context.Context, maintenance func(), interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		maintenance()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reviveOnce reconciles a single time like a manual recovery, volumes of csi-lvm before v0.5.0 are mounted as well if they have a persistent volume.
+// It fails if not all volumes created by csi-lvm could be mounted.
+func reviveOnce(ctx context.Context, r *reviver) error {
+	r.tagUntaggedLVs(ctx)
+	result := r.reconcile(ctx)
+	err := json.NewEncoder(os.Stdout).Encode(result)
+	if err != nil {
+		return fmt.Errorf("unable to print the result err:%w", err)
+	}
+	if result.Error != "" {
+		return fmt.Errorf("%s", result.Error)
+	}
+	if len(result.Pending) > 0 {
+		return fmt.Errorf("volumes not mounted: %s", strings.Join(result.Pending, ","))
+	}
+	return nil
+}
+
+// vgExtenderFromContext returns nil if the volumegroup should not be extended automatically
+func vgExtenderFromContext(c *cli.Context, recorder *eventRecorder) *vgExtender {
+	if !c.Bool(flagAutoExtend) {
+		klog.Info("automatic extension of the volumegroup is disabled")
+		return nil
+	}
+	if len(c.StringSlice(flagDevicesPattern)) == 0 {
+		klog.Infof("automatic extension of the volumegroup is disabled, no %s given", flagDevicesPattern)
+		return nil
+	}
+	selector, err := deviceSelectorFromContext(c)
+	if err != nil {
+		klog.Errorf("automatic extension of the volumegroup is disabled: %v", err)
+		return nil
+	}
+	return newVGExtender(recorder, c.String(flagVGName), selector)
+}
+
 // logStatus will log lvs and vgs to make them visible
-func logStatus() {
-	cmd := exec.Command("vgs")
-	out, err := cmd.CombinedOutput()
+func logStatus(ctx context.Context) {
+	out, err := lvm.Run(ctx, "vgs")
 	if err != nil {
-		klog.Errorf("unable to display volume group:%s %v", out, err)
+		klog.Errorf("unable to display volume group:%v", err)
 	}
 	klog.Infof("vgs output:%s", out)
-	cmd = exec.Command("lvs")
-	out, err = cmd.CombinedOutput()
+	// the tags show the claim of every volume
+	out, err = lvm.Run(ctx, "lvs", "--options", "+lv_tags")
 	if err != nil {
-		klog.Errorf("unable to display logical volume:%s %v", out, err)
+		klog.Errorf("unable to display logical volume:%v", err)
 	}
 	klog.Infof("lvs output:%s", out)
 }
 
-// reviveLVs scans for existing volumes which are not mounted correctly
-func reviveLVs(c *cli.Context) error {
+// reviveLVs activates the volumegroup and its logical volumes after a reboot and migrates their tags, the mounts are revived by the reconciliation
+func reviveLVs(c *cli.Context, recorder *eventRecorder) error {
 	klog.Info("starting reviver")
 	vgName := c.String(flagVGName)
 	if vgName == "" {
@@ -85,62 +287,7 @@ func reviveLVs(c *cli.Context) error {
 			return nil
 		}
 	}
-	cmd := exec.Command("lvchange", "--activate","y", vgName)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		klog.Infof("unable to activate logical volumes:%s %v", out, err)
-	}
-	lvs, err := commands.ListLV(context.Background(), vgName)
-	if err != nil {
-		klog.Infof("unable to list existing logicalvolumes:%v", err)
-	}
-	for _, lv := range lvs {
-		klog.Infof("inspect lv:%s\n", lv.Name)
-		targetPath := dirName + "/" + lv.Name
-		tp, err := os.Lstat(targetPath)
-		if err != nil {
-			klog.Infof("target %s is missing. Reviving ...\n", targetPath)
-			if lv.ActualDevMajNumber < 0 || lv.ActualDevMinNumber < 0 {
-				klog.Infof("logical volume %s seems broken. Skipping", lv.Name)
-				continue
-			}
-			for _, n := range lv.Tags {
-				if n == "isBlock=true" {
-					_, err := bindMountLV(lv.Name, vgName, dirName)
-					if err != nil {
-						klog.Errorf("unable to bind mount lv:%s error:%v", lv.Name, err)
-					}
-				} else if n == "isBlock=false" {
-					_, err := mountLV(lv.Name, vgName, dirName)
-					if err != nil {
-						klog.Errorf("unable to mount lv:%s error:%v", lv.Name, err)
-					}
-				}
-			}
-		} else {
-			// Check already existing volumes for missing isBlock tags and add tag if missing
-			// This is only needed for migrating from previous csi-lvm versions.
-			// This must only run once for every volume created with lvm-csi v0.4.x
-			// This else block can be removed later.
-			klog.Infof("target %s exists. Checking for missing isBlock tags ...\n", targetPath)
-			blockTagFound := false
-			for _, n := range lv.Tags {
-				if n == "isBlock=true" || n == "isBlock=false" {
-					blockTagFound = true
-				}
-			}
-			if !blockTagFound {
-				blockMode := true
-				if tp.Mode().IsDir() {
-					blockMode = false
-				}
-				klog.Infof("volume %s lacks isBlock tags. Readding isBlock=%t\n", targetPath, blockMode)
-				_, err := commands.AddTagLV(context.Background(), vgName, lv.Name, []string{"lv.metal-stack.io/csi-lvm", "isBlock=" + strconv.FormatBool(blockMode)})
-				if err != nil {
-					klog.Errorf("unable to add tag to lv:%s error:%v", lv.Name, err)
-				}
-			}
-		}
-	}
+	activateLVs(c.Context, recorder, vgName, c.Bool(flagDegraded))
+	migrateLVs(c.Context, vgName, dirName)
 	return nil
 }
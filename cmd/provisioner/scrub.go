@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// scrubTagPrefix is the lv tag which holds the unix time of the last completed scrub
+const scrubTagPrefix = "scrub.completed="
+
+// scrubLV holds the scrub relevant attributes of a raid logical volume
+type scrubLV struct {
+	name       string
+	segtype    string
+	syncAction string
+	mismatches uint64
+	completed  time.Time
+	tags       []string
+}
+
+func scrubLVs(ctx context.Context, vgName string) ([]scrubLV, error) {
+	lvs, err := lvm.LVs(ctx, vgName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list raid lvs of vg %s err:%w", vgName, err)
+	}
+	var result []scrubLV
+	for _, l := range lvs {
+		// raid0 has no redundancy which could be checked
+		if !strings.HasPrefix(l.SegType, "raid") || strings.HasPrefix(l.SegType, "raid0") {
+			continue
+		}
+		lv := scrubLV{
+			name:       l.Name,
+			segtype:    l.SegType,
+			syncAction: l.SyncAction,
+			mismatches: l.MismatchCount,
+			tags:       l.Tags,
+		}
+		for _, tag := range lv.tags {
+			if strings.HasPrefix(tag, scrubTagPrefix) {
+				unix, err := strconv.ParseInt(strings.TrimPrefix(tag, scrubTagPrefix), 10, 64)
+				if err == nil {
+					lv.completed = time.Unix(unix, 0)
+				}
+			}
+		}
+		result = append(result, lv)
+	}
+	return result, nil
+}
+
+// scrubber checks raid logical volumes for mismatches between their legs, one volume at a time.
+type scrubber struct {
+	recorder *eventRecorder
+	vgName   string
+	// interval between two scrubs of the same volume
+	interval time.Duration
+	// rate limits the scrub in lvchange --maxrecoveryrate format, e.g. 50M, unlimited if empty
+	rate   string
+	repair bool
+	// current is the volume which is scrubbed right now
+	current string
+	// repairing is true if the current scrub repairs the mismatches found before
+	repairing bool
+	// reported are the volumes with metrics, they are deleted if the volume is gone
+	reported map[string]bool
+}
+
+func newScrubber(recorder *eventRecorder, vgName string, interval time.Duration, rate string, repair bool) *scrubber {
+	return &scrubber{
+		recorder: recorder,
+		vgName:   vgName,
+		interval: interval,
+		rate:     rate,
+		repair:   repair,
+		reported: map[string]bool{},
+	}
+}
+
+// scrub is called periodically, it finishes the running scrub and starts the next one which is due
+func (s *scrubber) scrub(ctx context.Context) {
+	lvs, err := scrubLVs(ctx, s.vgName)
+	if err != nil {
+		klog.Errorf("unable to scrub: %v", err)
+		return
+	}
+
+	current := map[string]bool{}
+	for _, lv := range lvs {
+		current[lv.name] = true
+	}
+	for name := range s.reported {
+		if !current[name] {
+			raidScrubCompletion.DeleteLabelValues(name)
+			raidMismatchCount.DeleteLabelValues(name)
+			delete(s.reported, name)
+		}
+	}
+
+	for _, lv := range lvs {
+		if !lv.completed.IsZero() {
+			raidScrubCompletion.WithLabelValues(lv.name).Set(float64(lv.completed.Unix()))
+			raidMismatchCount.WithLabelValues(lv.name).Set(float64(lv.mismatches))
+			s.reported[lv.name] = true
+		}
+		if lv.syncAction == "check" || lv.syncAction == "repair" {
+			// still running, possibly started before a restart of the reviver
+			klog.Infof("%s of lv %s is running", lv.syncAction, lv.name)
+			s.current = lv.name
+			s.repairing = lv.syncAction == "repair"
+			return
+		}
+	}
+
+	if s.current != "" {
+		current, repairing := s.current, s.repairing
+		s.current, s.repairing = "", false
+		for _, lv := range lvs {
+			if lv.name != current {
+				continue
+			}
+			if repairing {
+				s.recorder.volumeEvent(ctx, lv.name, v1.EventTypeNormal, "ScrubRepaired", "repair of %s volume completed, %d mismatches repaired", lv.segtype, lv.mismatches)
+				continue
+			}
+			s.completed(ctx, lv)
+		}
+		if s.current != "" {
+			// a repair was started, it is limited as well
+			return
+		}
+		s.unlimit(ctx, current)
+	}
+
+	for _, lv := range lvs {
+		if time.Since(lv.completed) < s.interval {
+			continue
+		}
+		if lv.syncAction != "idle" {
+			// e.g. the initial sync or the recovery of a replaced leg
+			continue
+		}
+		s.start(ctx, lv)
+		return
+	}
+}
+
+func (s *scrubber) start(ctx context.Context, lv scrubLV) {
+	fullName := s.vgName + "/" + lv.name
+	if s.rate != "" {
+		_, err := lvm.Run(ctx, "lvchange", "--maxrecoveryrate", s.rate, fullName)
+		if err != nil {
+			klog.Errorf("unable to limit scrub rate of lv %s err:%v", lv.name, err)
+		}
+	}
+	klog.Infof("start scrub of lv %s", lv.name)
+	_, err := lvm.Run(ctx, "lvchange", "--syncaction", "check", fullName)
+	if err != nil {
+		s.recorder.volumeEvent(ctx, lv.name, v1.EventTypeWarning, "ScrubFailed", "unable to start scrub: %v", err)
+		raidScrubs.WithLabelValues("failed").Inc()
+		s.unlimit(ctx, lv.name)
+		return
+	}
+	s.current = lv.name
+}
+
+// unlimit removes the rate limit of a scrub, it is stored in the volume and would throttle the resync of a repaired leg as well
+func (s *scrubber) unlimit(ctx context.Context, lvName string) {
+	if s.rate == "" {
+		return
+	}
+	_, err := lvm.Run(ctx, "lvchange", "--maxrecoveryrate", "0", s.vgName+"/"+lvName)
+	if err != nil && !errors.Is(err, lvm.ErrNotFound) {
+		klog.Errorf("unable to remove scrub rate limit of lv %s err:%v", lvName, err)
+	}
+}
+
+// completed records the result of a finished scrub and starts a repair if mismatches were found
+func (s *scrubber) completed(ctx context.Context, lv scrubLV) {
+	now := time.Now()
+	klog.Infof("scrub of lv %s completed with %d mismatches", lv.name, lv.mismatches)
+	raidScrubCompletion.WithLabelValues(lv.name).Set(float64(now.Unix()))
+	raidMismatchCount.WithLabelValues(lv.name).Set(float64(lv.mismatches))
+	s.reported[lv.name] = true
+
+	var oldTags []string
+	for _, tag := range lv.tags {
+		if strings.HasPrefix(tag, scrubTagPrefix) {
+			oldTags = append(oldTags, tag)
+		}
+	}
+	if len(oldTags) > 0 {
+		err := lvm.DeleteTags(ctx, s.vgName, lv.name, oldTags...)
+		if err != nil {
+			klog.Errorf("unable to remove tags %s from lv:%s error:%v", oldTags, lv.name, err)
+		}
+	}
+	err := lvm.AddTags(ctx, s.vgName, lv.name, scrubTagPrefix+strconv.FormatInt(now.Unix(), 10))
+	if err != nil {
+		klog.Errorf("unable to add scrub tag to lv:%s error:%v", lv.name, err)
+	}
+
+	if lv.mismatches == 0 {
+		raidScrubs.WithLabelValues("clean").Inc()
+		return
+	}
+	raidScrubs.WithLabelValues("mismatches").Inc()
+	s.recorder.volumeEvent(ctx, lv.name, v1.EventTypeWarning, "ScrubMismatches", "scrub of %s volume found %d mismatches, repair:%t", lv.segtype, lv.mismatches, s.repair)
+	if !s.repair {
+		return
+	}
+	_, err = lvm.Run(ctx, "lvchange", "--syncaction", "repair", s.vgName+"/"+lv.name)
+	if err != nil {
+		s.recorder.volumeEvent(ctx, lv.name, v1.EventTypeWarning, "ScrubRepairFailed", "unable to start repair: %v", err)
+		return
+	}
+	s.current = lv.name
+	s.repairing = true
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	"github.com/metal-stack/csi-lvm/internal/status"
+	"github.com/metal-stack/csi-lvm/internal/volume"
+	"github.com/urfave/cli/v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+const (
+	flagOutput = "output"
+
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+func statusCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "status",
+		Usage: "print the volumegroup, its physical volumes and the logical volumes of csi-lvm with their mounts, usage and raid health",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+				Value: "csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:    flagDirectory,
+				Usage:   "Required. the name of the directory the lvs are mounted",
+				EnvVars: []string{envDirectory},
+				Value:   "/tmp/csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Optional. the name of the node, it is part of the report",
+				EnvVars: []string{envNodeName},
+			},
+			&cli.StringFlag{
+				Name:  flagOutput,
+				Usage: "Optional. the format of the report: table or json",
+				Value: outputTable,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			vgName := c.String(flagVGName)
+			if vgName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagVGName)
+			}
+			dirName := c.String(flagDirectory)
+			if dirName == "" {
+				return fmt.Errorf("invalid empty flag %v", flagDirectory)
+			}
+			report := vgStatus(c.Context, vgName, dirName)
+			report.Node = c.String(flagNodeName)
+			var err error
+			switch c.String(flagOutput) {
+			case outputJSON:
+				err = json.NewEncoder(os.Stdout).Encode(report)
+			case outputTable:
+				err = printStatus(os.Stdout, report)
+			default:
+				err = fmt.Errorf("invalid output %s, must be %s or %s", c.String(flagOutput), outputTable, outputJSON)
+			}
+			if err != nil {
+				klog.Fatalf("Error printing status: %v", err)
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// vgStatus reports the volumegroup, errors of single parts are part of the report
+func vgStatus(ctx context.Context, vgName, dirName string) status.Report {
+	report := status.Report{Time: time.Now()}
+	vg, err := lvm.LookupVG(ctx, vgName)
+	if errors.Is(err, lvm.ErrNotFound) {
+		return report
+	}
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else {
+		report.VG = &status.VG{
+			Name:    vg.Name,
+			Size:    vg.Size,
+			Free:    vg.Free,
+			PVCount: vg.PVCount,
+			LVCount: vg.LVCount,
+		}
+	}
+
+	pvs, err := lvm.PVs(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, pv := range pvs {
+		if pv.VGName != vgName {
+			continue
+		}
+		report.PVs = append(report.PVs, status.PV{
+			Device:  pv.Name,
+			Size:    pv.Size,
+			Free:    pv.Free,
+			Missing: pv.Missing,
+		})
+	}
+
+	mountInfos, err := mounts()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("unable to read mounts:%v", err))
+	}
+	lvs, err := lvm.LVs(ctx, vgName)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	for _, lv := range lvs {
+		if !lv.HasTag(lvTag) {
+			continue
+		}
+		mountpoint := path.Join(dirName, lv.Name)
+		_, mounted := mountInfos[mountpoint]
+		s := status.LV{
+			Name:       lv.Name,
+			Size:       lv.Size,
+			Type:       lv.SegType,
+			Block:      lv.HasTag("isBlock=true"),
+			Active:     lv.Active,
+			Tags:       lv.Tags,
+			Claim:      volume.Owner(lv.Tags),
+			Mountpoint: mountpoint,
+			Mounted:    mounted,
+		}
+		if strings.HasPrefix(s.Type, "raid") {
+			s.Health = degraded(&lv)
+			s.SyncPercent = lv.SyncPercent
+		}
+		if mounted && !s.Block {
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(mountpoint, &fs); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("unable to determine the usage of %s:%v", mountpoint, err))
+			} else {
+				s.Usage = &status.Usage{
+					Size:      fs.Blocks * uint64(fs.Bsize),
+					Used:      (fs.Blocks - fs.Bfree) * uint64(fs.Bsize),
+					Available: fs.Bavail * uint64(fs.Bsize),
+				}
+			}
+		}
+		report.LVs = append(report.LVs, s)
+	}
+	slices.SortFunc(report.LVs, func(a, b status.LV) int { return strings.Compare(a.Name, b.Name) })
+	return report
+}
+
+func formatBytes(n uint64) string {
+	return resource.NewQuantity(int64(n), resource.BinarySI).String()
+}
+
+// printStatus prints the report as tables for humans
+func printStatus(out io.Writer, report status.Report) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if report.VG == nil {
+		fmt.Fprintln(w, "no volumegroup")
+	} else {
+		fmt.Fprintln(w, "VG\tSIZE\tFREE\tPVS\tLVS")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", report.VG.Name, formatBytes(report.VG.Size), formatBytes(report.VG.Free), report.VG.PVCount, report.VG.LVCount)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "PV\tSIZE\tFREE\tSTATUS")
+		for _, pv := range report.PVs {
+			state := "ok"
+			if pv.Missing {
+				state = "missing"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", pv.Device, formatBytes(pv.Size), formatBytes(pv.Free), state)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "LV\tCLAIM\tSIZE\tTYPE\tMODE\tSTATE\tUSED\tHEALTH")
+		for _, lv := range report.LVs {
+			claim, mode, state, used, health := "-", "filesystem", "not mounted", "-", "ok"
+			if lv.Claim != "" {
+				claim = lv.Claim
+			}
+			if lv.Block {
+				mode = "block"
+			}
+			switch {
+			case !lv.Active:
+				state = "inactive"
+			case lv.Mounted:
+				state = "mounted"
+			}
+			if lv.Usage != nil && lv.Usage.Size > 0 {
+				used = fmt.Sprintf("%s (%d%%)", formatBytes(lv.Usage.Used), 100*lv.Usage.Used/lv.Usage.Size)
+			}
+			if lv.Health != "" {
+				health = lv.Health
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", lv.Name, claim, formatBytes(lv.Size), lv.Type, mode, state, used, health)
+		}
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintf(w, "error: %s\n", e)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/metal-stack/csi-lvm/internal/lvm"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// notReadyTaintKey keeps pods away from the node until all volumes are mounted
+const notReadyTaintKey = "csi-lvm.metal-stack.io/not-ready"
+
+const (
+	// taintPolicyKeep keeps the taint after the timeout until all volumes are mounted
+	taintPolicyKeep = "keep"
+	// taintPolicyRemove removes the taint after the timeout even if volumes are not mounted
+	taintPolicyRemove = "remove"
+)
+
+// nodeTaint manages the not ready taint of the node the reviver runs on
+type nodeTaint struct {
+	recorder *eventRecorder
+	timeout  time.Duration
+	policy   string
+	started  time.Time
+	// done is true once the taint was removed
+	done     bool
+	timedOut bool
+}
+
+func newNodeTaint(recorder *eventRecorder, timeout time.Duration, policy string) (*nodeTaint, error) {
+	if policy != taintPolicyKeep && policy != taintPolicyRemove {
+		return nil, fmt.Errorf("invalid taint timeout policy %q, must be %s or %s", policy, taintPolicyKeep, taintPolicyRemove)
+	}
+	return &nodeTaint{
+		recorder: recorder,
+		timeout:  timeout,
+		policy:   policy,
+		started:  time.Now(),
+	}, nil
+}
+
+// taint adds the taint on startup, unless all volumes are already mounted because only the reviver was restarted
+func (t *nodeTaint) taint(ctx context.Context, vgName, dirName string) {
+	if t.recorder.client == nil {
+		klog.Info("no access to the api server, node is not tainted")
+		t.done = true
+		return
+	}
+	// a taint registered by the kubelet or left by a previous reviver is removed with the next reconciliation in any case
+	pending, err := unmountedLVs(ctx, vgName, dirName)
+	if errors.Is(err, lvm.ErrNotFound) {
+		klog.Infof("volumegroup %s not found, node is not tainted", vgName)
+		return
+	}
+	if err != nil {
+		// pods of the node must not be evicted only because lvm failed
+		klog.Errorf("unable to find unmounted volumes, node is not tainted: %v", err)
+		return
+	}
+	if len(pending) == 0 {
+		klog.Info("all volumes are mounted, node is not tainted")
+		return
+	}
+	klog.Infof("volumes not mounted: %s", strings.Join(pending, ","))
+	err = t.update(ctx, true)
+	if err != nil {
+		klog.Errorf("unable to taint node: %v", err)
+	}
+}
+
+// reconciled removes the taint once all volumes are mounted or the timeout with the remove policy expired
+func (t *nodeTaint) reconciled(ctx context.Context, result reconcileResult) {
+	if t.done {
+		return
+	}
+	ready := result.Error == "" && len(result.Pending) == 0
+	if !ready {
+		if t.timeout <= 0 || time.Since(t.started) < t.timeout || t.timedOut {
+			return
+		}
+		t.timedOut = true
+		reason := result.Error
+		if reason == "" {
+			reason = "volumes not mounted: " + strings.Join(result.Pending, ",")
+		}
+		if t.policy == taintPolicyKeep {
+			t.recorder.nodeEvent(ctx, v1.EventTypeWarning, "VolumesNotReady", "volumes are not ready after %s, taint %s is kept: %s", t.timeout, notReadyTaintKey, reason)
+			return
+		}
+		t.recorder.nodeEvent(ctx, v1.EventTypeWarning, "VolumesNotReady", "volumes are not ready after %s, taint %s is removed: %s", t.timeout, notReadyTaintKey, reason)
+	}
+	err := t.update(ctx, false)
+	if err != nil {
+		klog.Errorf("unable to remove taint from node: %v", err)
+		return
+	}
+	t.done = true
+	if ready {
+		klog.Infof("all %d volumes are mounted, node is ready", result.Mounted)
+	}
+}
+
+// update adds or removes the taint, the node is only updated if necessary
+func (t *nodeTaint) update(ctx context.Context, tainted bool) error {
+	nodes := t.recorder.client.CoreV1().Nodes()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := nodes.Get(ctx, t.recorder.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		index := slices.IndexFunc(node.Spec.Taints, func(taint v1.Taint) bool {
+			return taint.Key == notReadyTaintKey
+		})
+		switch {
+		case tainted && index < 0:
+			now := metav1.Now()
+			node.Spec.Taints = append(node.Spec.Taints, v1.Taint{
+				Key:       notReadyTaintKey,
+				Effect:    v1.TaintEffectNoExecute,
+				TimeAdded: &now,
+			})
+		case !tainted && index >= 0:
+			node.Spec.Taints = slices.Delete(node.Spec.Taints, index, index+1)
+		default:
+			return nil
+		}
+		// the taints are replaced by a merge patch, the resource version detects concurrent changes
+		patch := map[string]any{
+			"metadata": map[string]any{"resourceVersion": node.ResourceVersion},
+			"spec":     map[string]any{"taints": node.Spec.Taints},
+		}
+		data, err := json.Marshal(patch)
+		if err != nil {
+			return err
+		}
+		_, err = nodes.Patch(ctx, node.Name, types.MergePatchType, data, metav1.PatchOptions{})
+		if err == nil {
+			klog.Infof("taint %s of node %s set to %t", notReadyTaintKey, t.recorder.nodeName, tainted)
+		}
+		return err
+	})
+}
+
+// unmountedLVs returns the logical volumes created by csi-lvm which are not mounted, active or not
+func unmountedLVs(ctx context.Context, vgName, dirName string) ([]string, error) {
+	lvs, err := lvm.LVs(ctx, vgName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list logical volumes of vg %s err:%w", vgName, err)
+	}
+	mountInfos, err := mounts()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, lv := range lvs {
+		if !lv.HasTag(lvTag) {
+			continue
+		}
+		if _, ok := mountInfos[path.Join(dirName, lv.Name)]; !ok {
+			result = append(result, lv.Name)
+		}
+	}
+	return result, nil
+}
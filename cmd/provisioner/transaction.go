@@ -0,0 +1,56 @@
+package main
+
+import (
+	"k8s.io/klog/v2"
+)
+
+// transaction records the completed steps of an operation on a logical volume
+// to roll them back in reverse order if a later step fails
+type transaction struct {
+	lvName string
+	steps  []transactionStep
+}
+
+type transactionStep struct {
+	name string
+	undo func() error
+}
+
+func newTransaction(lvName string) *transaction {
+	return &transaction{lvName: lvName}
+}
+
+// step runs a step, its undo is recorded before because a failed step may be half done.
+// undo must cope with a step which did nothing, it is nil if the step needs no rollback.
+func (t *transaction) step(name string, do func() error, undo func() error) error {
+	klog.Infof("lv %s: %s", t.lvName, name)
+	if undo != nil {
+		t.steps = append(t.steps, transactionStep{name: name, undo: undo})
+	}
+	err := do()
+	if err != nil {
+		klog.Errorf("lv %s: %s failed: %v", t.lvName, name, err)
+		return err
+	}
+	klog.Infof("lv %s: %s done", t.lvName, name)
+	return nil
+}
+
+// rollback undoes the recorded steps in reverse order, failures are logged and the remaining steps are undone anyway
+func (t *transaction) rollback() {
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		s := t.steps[i]
+		klog.Infof("lv %s: rollback %s", t.lvName, s.name)
+		if err := s.undo(); err != nil {
+			klog.Errorf("lv %s: rollback %s failed: %v", t.lvName, s.name, err)
+		}
+	}
+	t.steps = nil
+}
+
+// keep logs the steps which are not rolled back
+func (t *transaction) keep() {
+	for _, s := range t.steps {
+		klog.Warningf("lv %s: %s is not rolled back", t.lvName, s.name)
+	}
+}
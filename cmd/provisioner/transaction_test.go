@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	errStep := errors.New("step failed")
+	tests := []struct {
+		name string
+		// failAt is the index of the failing step, -1 if all succeed
+		failAt int
+		// noUndo are the steps without undo
+		noUndo map[int]bool
+		// failingUndo are the steps whose undo fails
+		failingUndo map[int]bool
+		want        []string
+	}{
+		{
+			name:   "undo in reverse order",
+			failAt: -1,
+			want:   []string{"undo 2", "undo 1", "undo 0"},
+		},
+		{
+			name:   "failed step is undone as well",
+			failAt: 1,
+			want:   []string{"undo 1", "undo 0"},
+		},
+		{
+			name:   "steps without undo are skipped",
+			failAt: 2,
+			noUndo: map[int]bool{1: true},
+			want:   []string{"undo 2", "undo 0"},
+		},
+		{
+			name:        "failed undo does not stop the rollback",
+			failAt:      -1,
+			failingUndo: map[int]bool{1: true},
+			want:        []string{"undo 2", "undo 1", "undo 0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			tx := newTransaction("pvc-1")
+			for i := range 3 {
+				var undo func() error
+				if !tt.noUndo[i] {
+					undo = func() error {
+						got = append(got, "undo "+strconv.Itoa(i))
+						if tt.failingUndo[i] {
+							return errors.New("undo failed")
+						}
+						return nil
+					}
+				}
+				err := tx.step("step", func() error {
+					if i == tt.failAt {
+						return errStep
+					}
+					return nil
+				}, undo)
+				if i == tt.failAt {
+					if !errors.Is(err, errStep) {
+						t.Fatalf("step() error = %v, want %v", err, errStep)
+					}
+					break
+				}
+			}
+			tx.rollback()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rollback() = %v, want %v", got, tt.want)
+			}
+
+			// a second rollback does nothing
+			got = nil
+			tx.rollback()
+			if len(got) != 0 {
+				t.Errorf("second rollback() = %v, want nothing", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Package lvm runs the lvm commands of the provisioner. Reports are read with --reportformat json into typed structs,
+// names are matched exactly and failed commands return an *Error which is classified by the errors of this package.
+package lvm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned if a volume group, physical or logical volume does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrInsufficientSpace is returned if the volume group has not enough free space or physical volumes for a volume
+	ErrInsufficientSpace = errors.New("insufficient space")
+	// ErrLocked is returned if lvm could not acquire a lock, e.g. because another command runs
+	ErrLocked = errors.New("locked")
+	// ErrMissingPV is returned if a physical volume of the volume group is missing
+	ErrMissingPV = errors.New("missing physical volume")
+)
+
+// classes map the error lines of failed commands to the errors above, the first matching class wins
+var classes = []struct {
+	err      error
+	messages []string
+}{
+	{ErrMissingPV, []string{"while pvs are missing", "missing physical volume", "activation of partial lv"}},
+	{ErrLocked, []string{"can't get lock", "failed to lock", "lock failed", "resource temporarily unavailable", "locking type", "lock held"}},
+	{ErrInsufficientSpace, []string{"insufficient free space", "insufficient suitable", "insufficient free extents", "number of stripes exceeds", "not enough free space"}},
+	{ErrNotFound, []string{"not found", "failed to find", "cannot process volume group"}},
+}
+
+// Error is a failed lvm command
+type Error struct {
+	Command string
+	Args    []string
+	// Output is stderr of the command
+	Output string
+	Err    error
+	// class is one of the errors of this package, nil if unknown
+	class error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s failed: %v %s", e.Command, strings.Join(e.Args, " "), e.Err, e.Output)
+}
+
+// Unwrap makes the class of the error available to errors.Is
+func (e *Error) Unwrap() []error {
+	if e.class == nil {
+		return []error{e.Err}
+	}
+	return []error{e.class, e.Err}
+}
+
+// classify returns the class of the output of a failed command. Warnings are ignored, on a volume group with
+// a missing physical volume every command warns about it, even if it failed for another reason.
+func classify(output string) error {
+	var lines []string
+	for _, line := range strings.Split(strings.ToLower(output), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "warning:") {
+			lines = append(lines, line)
+		}
+	}
+	output = strings.Join(lines, "\n")
+	for _, c := range classes {
+		for _, message := range c.messages {
+			if strings.Contains(output, message) {
+				return c.err
+			}
+		}
+	}
+	return nil
+}
+
+// Run runs a lvm command and returns its stdout
+func Run(ctx context.Context, command string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		output := strings.TrimSpace(stderr.String())
+		if output == "" {
+			output = strings.TrimSpace(stdout.String())
+		}
+		return stdout.String(), &Error{Command: command, Args: args, Output: output, Err: err, class: classify(output)}
+	}
+	return stdout.String(), nil
+}
+
+// AddTags adds tags to a logical volume
+func AddTags(ctx context.Context, vgName, lvName string, tags ...string) error {
+	return changeTags(ctx, "--addtag", vgName, lvName, tags)
+}
+
+// DeleteTags removes tags from a logical volume
+func DeleteTags(ctx context.Context, vgName, lvName string, tags ...string) error {
+	return changeTags(ctx, "--deltag", vgName, lvName, tags)
+}
+
+func changeTags(ctx context.Context, flag, vgName, lvName string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	var args []string
+	for _, tag := range tags {
+		args = append(args, flag, tag)
+	}
+	_, err := Run(ctx, "lvchange", append(args, vgName+"/"+lvName)...)
+	return err
+}
+
+// RemoveLV removes a logical volume, it must not be open
+func RemoveLV(ctx context.Context, vgName, lvName string) error {
+	_, err := Run(ctx, "lvremove", "--yes", vgName+"/"+lvName)
+	return err
+}
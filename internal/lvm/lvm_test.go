@@ -0,0 +1,135 @@
+package lvm
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   error
+	}{
+		{
+			name:   "volume group not found",
+			output: `  Volume group "csi-lvm" not found`,
+			want:   ErrNotFound,
+		},
+		{
+			name:   "logical volume not found",
+			output: `  Failed to find logical volume "csi-lvm/pvc-1"`,
+			want:   ErrNotFound,
+		},
+		{
+			name:   "insufficient space",
+			output: `  Volume group "csi-lvm" has insufficient free space (255 extents): 256 required.`,
+			want:   ErrInsufficientSpace,
+		},
+		{
+			name:   "not enough physical volumes for raid",
+			output: `  Insufficient suitable allocatable extents for logical volume pvc-1: 512 more required`,
+			want:   ErrInsufficientSpace,
+		},
+		{
+			name:   "locked",
+			output: `  Giving up waiting for lock. Can't get lock for csi-lvm.`,
+			want:   ErrLocked,
+		},
+		{
+			name: "logical volume not found in a degraded volume group",
+			output: "  WARNING: Couldn't find device with uuid Yp3b1I-Kd8e-fC2O-Nn3T-s1Wd-xQ9a-7ZkLmP.\n" +
+				"  WARNING: VG csi-lvm is missing PV Yp3b1I-Kd8e-fC2O-Nn3T-s1Wd-xQ9a-7ZkLmP (last written to /dev/sdc).\n" +
+				"  Failed to find logical volume \"csi-lvm/pvc-1\"",
+			want: ErrNotFound,
+		},
+		{
+			name: "insufficient space in a degraded volume group",
+			output: "  WARNING: Couldn't find device with uuid Yp3b1I-Kd8e-fC2O-Nn3T-s1Wd-xQ9a-7ZkLmP.\n" +
+				"  WARNING: VG csi-lvm is missing PV Yp3b1I-Kd8e-fC2O-Nn3T-s1Wd-xQ9a-7ZkLmP (last written to /dev/sdc).\n" +
+				"  Volume group \"csi-lvm\" has insufficient free space (255 extents): 256 required.",
+			want: ErrInsufficientSpace,
+		},
+		{
+			name: "change of a degraded volume group",
+			output: "  WARNING: Couldn't find device with uuid Yp3b1I-Kd8e-fC2O-Nn3T-s1Wd-xQ9a-7ZkLmP.\n" +
+				"  WARNING: VG csi-lvm is missing PV Yp3b1I-Kd8e-fC2O-Nn3T-s1Wd-xQ9a-7ZkLmP (last written to /dev/sdc).\n" +
+				"  Cannot change VG csi-lvm while PVs are missing.\n" +
+				"  See vgreduce --removemissing and vgextend --restoremissing.\n" +
+				"  Cannot process volume group csi-lvm",
+			want: ErrMissingPV,
+		},
+		{
+			name: "activation of a partial logical volume",
+			output: "  WARNING: Couldn't find device with uuid Yp3b1I-Kd8e-fC2O-Nn3T-s1Wd-xQ9a-7ZkLmP.\n" +
+				"  Refusing activation of partial LV csi-lvm/pvc-1.  Use '--activationmode partial' to override.",
+			want: ErrMissingPV,
+		},
+		{
+			name:   "warnings only",
+			output: "  WARNING: Couldn't find device with uuid Yp3b1I-Kd8e-fC2O-Nn3T-s1Wd-xQ9a-7ZkLmP.",
+			want:   nil,
+		},
+		{
+			name:   "unknown",
+			output: `  Device /dev/sdb excluded by a filter.`,
+			want:   nil,
+		},
+		{
+			name:   "empty",
+			output: "",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classify(tt.output)
+			if got != tt.want {
+				t.Errorf("classify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	exitErr := &exec.ExitError{}
+	tests := []struct {
+		name    string
+		err     *Error
+		target  error
+		matches bool
+	}{
+		{
+			name:    "class",
+			err:     &Error{Command: "lvs", Err: exitErr, class: ErrNotFound},
+			target:  ErrNotFound,
+			matches: true,
+		},
+		{
+			name:    "other class",
+			err:     &Error{Command: "lvs", Err: exitErr, class: ErrNotFound},
+			target:  ErrLocked,
+			matches: false,
+		},
+		{
+			name:    "unknown class",
+			err:     &Error{Command: "lvs", Err: exitErr},
+			target:  ErrNotFound,
+			matches: false,
+		},
+		{
+			name:    "underlying error",
+			err:     &Error{Command: "lvs", Err: exitErr, class: ErrLocked},
+			target:  exitErr,
+			matches: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errors.Is(tt.err, tt.target); got != tt.matches {
+				t.Errorf("errors.Is() = %v, want %v", got, tt.matches)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VG is a volume group, sizes are in bytes
+type VG struct {
+	Name           string
+	Size           uint64
+	Free           uint64
+	PVCount        int
+	LVCount        int
+	MissingPVCount int
+}
+
+// PV is a physical volume
+type PV struct {
+	Name string
+	// VGName is empty if the physical volume is not part of a volume group
+	VGName  string
+	Size    uint64
+	Free    uint64
+	Missing bool
+}
+
+// LV is a logical volume
+type LV struct {
+	Name    string
+	VGName  string
+	Size    uint64
+	Attr    string
+	SegType string
+	Active  bool
+	// Open is true if the volume is mounted or used by another process
+	Open bool
+	// Health is the health status of raid volumes, e.g. partial or refresh needed
+	Health        string
+	SyncPercent   string
+	SyncAction    string
+	MismatchCount uint64
+	Tags          []string
+	// Time is the creation time
+	Time time.Time
+	// Major and Minor are the device numbers, -1 if the volume is not active
+	Major int
+	Minor int
+}
+
+// Hidden is true for the sub volumes of raid volumes
+func (lv *LV) Hidden() bool {
+	return strings.HasPrefix(lv.Name, "[")
+}
+
+// HasTag returns true if the logical volume has the tag
+func (lv *LV) HasTag(tag string) bool {
+	return slices.Contains(lv.Tags, tag)
+}
+
+// Partial is true if extents of the logical volume are on missing physical volumes
+func (lv *LV) Partial() bool {
+	return len(lv.Attr) >= 9 && lv.Attr[8] == 'p'
+}
+
+// Segment is a part of a logical volume, including hidden ones, on physical volumes
+type Segment struct {
+	LVName string
+	// Devices are the physical volumes with their first extent, e.g. /dev/sda(0)
+	Devices []string
+}
+
+const (
+	vgOptions  = "vg_name,vg_size,vg_free,pv_count,lv_count,vg_missing_pv_count"
+	pvOptions  = "pv_name,vg_name,pv_size,pv_free,pv_missing"
+	lvOptions  = "lv_name,vg_name,lv_size,lv_attr,segtype,lv_active,lv_device_open,lv_health_status,sync_percent,raid_sync_action,raid_mismatch_count,lv_tags,lv_time,lv_kernel_major,lv_kernel_minor"
+	segOptions = "lv_name,devices"
+)
+
+// report runs a lvm reporting command and returns its rows, values are strings and sizes in bytes
+func report(ctx context.Context, command string, args ...string) ([]map[string]string, error) {
+	args = append([]string{"--reportformat", "json", "--units", "b", "--nosuffix", "--config", `report/time_format="%s"`}, args...)
+	out, err := Run(ctx, command, args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseReport(command, out)
+}
+
+// parseReport returns the rows of the json output of a lvm reporting command
+func parseReport(command, out string) ([]map[string]string, error) {
+	var result struct {
+		// the name of the rows depends on the command and the fields, e.g. vg, lv or seg
+		Report []map[string][]map[string]string `json:"report"`
+	}
+	err := json.Unmarshal([]byte(out), &result)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the output of %s err:%w", command, err)
+	}
+	var rows []map[string]string
+	for _, r := range result.Report {
+		for _, values := range r {
+			rows = append(rows, values...)
+		}
+	}
+	return rows, nil
+}
+
+func parseUint(value string) uint64 {
+	n, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	return n
+}
+
+func parseInt(value string, empty int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return empty
+	}
+	return n
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// VGs returns all volume groups
+func VGs(ctx context.Context) ([]VG, error) {
+	return vgs(ctx)
+}
+
+// LookupVG returns the volume group, ErrNotFound if it does not exist
+func LookupVG(ctx context.Context, name string) (*VG, error) {
+	result, err := vgs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, vg := range result {
+		if vg.Name == name {
+			return &vg, nil
+		}
+	}
+	return nil, fmt.Errorf("volume group %s %w", name, ErrNotFound)
+}
+
+func vgs(ctx context.Context, names ...string) ([]VG, error) {
+	rows, err := report(ctx, "vgs", append([]string{"--options", vgOptions}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	var result []VG
+	for _, row := range rows {
+		result = append(result, VG{
+			Name:           row["vg_name"],
+			Size:           parseUint(row["vg_size"]),
+			Free:           parseUint(row["vg_free"]),
+			PVCount:        parseInt(row["pv_count"], 0),
+			LVCount:        parseInt(row["lv_count"], 0),
+			MissingPVCount: parseInt(row["vg_missing_pv_count"], 0),
+		})
+	}
+	return result, nil
+}
+
+// PVs returns all physical volumes, also those without a volume group
+func PVs(ctx context.Context) ([]PV, error) {
+	rows, err := report(ctx, "pvs", "--options", pvOptions)
+	if err != nil {
+		return nil, err
+	}
+	var result []PV
+	for _, row := range rows {
+		result = append(result, PV{
+			Name:    row["pv_name"],
+			VGName:  row["vg_name"],
+			Size:    parseUint(row["pv_size"]),
+			Free:    parseUint(row["pv_free"]),
+			Missing: row["pv_missing"] != "",
+		})
+	}
+	return result, nil
+}
+
+// LVs returns the logical volumes of the volume group without the hidden sub volumes
+func LVs(ctx context.Context, vgName string) ([]LV, error) {
+	return lvs(ctx, vgName)
+}
+
+// LookupLV returns the logical volume with exactly this name, ErrNotFound if it does not exist
+func LookupLV(ctx context.Context, vgName, name string) (*LV, error) {
+	result, err := lvs(ctx, vgName+"/"+name)
+	if err != nil {
+		return nil, err
+	}
+	lv := findLV(result, name)
+	if lv == nil {
+		return nil, fmt.Errorf("logical volume %s/%s %w", vgName, name, ErrNotFound)
+	}
+	return lv, nil
+}
+
+// findLV returns the logical volume with exactly this name, nil if there is none
+func findLV(lvs []LV, name string) *LV {
+	for _, lv := range lvs {
+		if lv.Name == name {
+			return &lv
+		}
+	}
+	return nil
+}
+
+func lvs(ctx context.Context, name string) ([]LV, error) {
+	rows, err := report(ctx, "lvs", "--options", lvOptions, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseLVs(rows), nil
+}
+
+// parseLVs returns the logical volumes of the rows of a lvs report
+func parseLVs(rows []map[string]string) []LV {
+	var result []LV
+	for _, row := range rows {
+		// segment fields like segtype report a row per segment
+		if slices.ContainsFunc(result, func(lv LV) bool { return lv.Name == row["lv_name"] }) {
+			continue
+		}
+		lv := LV{
+			Name:          row["lv_name"],
+			VGName:        row["vg_name"],
+			Size:          parseUint(row["lv_size"]),
+			Attr:          row["lv_attr"],
+			SegType:       row["segtype"],
+			Active:        row["lv_active"] == "active",
+			Open:          row["lv_device_open"] == "open",
+			Health:        row["lv_health_status"],
+			SyncPercent:   row["sync_percent"],
+			SyncAction:    row["raid_sync_action"],
+			MismatchCount: parseUint(row["raid_mismatch_count"]),
+			Tags:          splitList(row["lv_tags"]),
+			Major:         parseInt(row["lv_kernel_major"], -1),
+			Minor:         parseInt(row["lv_kernel_minor"], -1),
+		}
+		if unix, err := strconv.ParseInt(row["lv_time"], 10, 64); err == nil {
+			lv.Time = time.Unix(unix, 0)
+		}
+		result = append(result, lv)
+	}
+	return result
+}
+
+// Segments returns the segments of all logical volumes of the volume group, including hidden ones
+func Segments(ctx context.Context, vgName string) ([]Segment, error) {
+	rows, err := report(ctx, "lvs", "--all", "--options", segOptions, vgName)
+	if err != nil {
+		return nil, err
+	}
+	var result []Segment
+	for _, row := range rows {
+		result = append(result, Segment{LVName: row["lv_name"], Devices: splitList(row["devices"])})
+	}
+	return result, nil
+}
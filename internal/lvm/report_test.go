@@ -0,0 +1,130 @@
+package lvm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const lvsReport = `{
+  "report": [
+    {
+      "lv": [
+        {"lv_name":"pvc-1", "vg_name":"csi-lvm", "lv_size":"1073741824", "lv_attr":"-wi-ao----", "segtype":"linear", "lv_active":"active", "lv_device_open":"open", "lv_health_status":"", "sync_percent":"", "raid_sync_action":"", "raid_mismatch_count":"", "lv_tags":"lv.metal-stack.io/csi-lvm,isBlock=false", "lv_time":"1700000000", "lv_kernel_major":"253", "lv_kernel_minor":"1"},
+        {"lv_name":"pvc-1", "vg_name":"csi-lvm", "lv_size":"1073741824", "lv_attr":"-wi-ao----", "segtype":"linear", "lv_active":"active", "lv_device_open":"open", "lv_health_status":"", "sync_percent":"", "raid_sync_action":"", "raid_mismatch_count":"", "lv_tags":"lv.metal-stack.io/csi-lvm,isBlock=false", "lv_time":"1700000000", "lv_kernel_major":"253", "lv_kernel_minor":"1"},
+        {"lv_name":"pvc-10", "vg_name":"csi-lvm", "lv_size":"2147483648", "lv_attr":"rwi-a-r---", "segtype":"raid1", "lv_active":"active", "lv_device_open":"", "lv_health_status":"", "sync_percent":"100.00", "raid_sync_action":"idle", "raid_mismatch_count":"3", "lv_tags":"", "lv_time":"1700000060", "lv_kernel_major":"", "lv_kernel_minor":""}
+      ]
+    }
+  ]
+}`
+
+func TestParseReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    []map[string]string
+		wantErr bool
+	}{
+		{
+			name: "volume groups",
+			out:  `{"report":[{"vg":[{"vg_name":"csi-lvm","vg_size":"10737418240"},{"vg_name":"other","vg_size":"0"}]}]}`,
+			want: []map[string]string{
+				{"vg_name": "csi-lvm", "vg_size": "10737418240"},
+				{"vg_name": "other", "vg_size": "0"},
+			},
+		},
+		{
+			name: "log of newer lvm versions is ignored",
+			out:  `{"report":[{"pv":[{"pv_name":"/dev/sda"}]}],"log":[{"log_seq_num":"1"}]}`,
+			want: []map[string]string{{"pv_name": "/dev/sda"}},
+		},
+		{
+			name: "empty report",
+			out:  `{"report":[{"lv":[]}]}`,
+			want: nil,
+		},
+		{
+			name:    "no json",
+			out:     "  Volume group \"csi-lvm\" not found",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseReport("lvs", tt.out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseReport() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLVs(t *testing.T) {
+	rows, err := parseReport("lvs", lvsReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseLVs(rows)
+	want := []LV{
+		{
+			Name:    "pvc-1",
+			VGName:  "csi-lvm",
+			Size:    1073741824,
+			Attr:    "-wi-ao----",
+			SegType: "linear",
+			Active:  true,
+			Open:    true,
+			Tags:    []string{"lv.metal-stack.io/csi-lvm", "isBlock=false"},
+			Time:    time.Unix(1700000000, 0),
+			Major:   253,
+			Minor:   1,
+		},
+		{
+			Name:          "pvc-10",
+			VGName:        "csi-lvm",
+			Size:          2147483648,
+			Attr:          "rwi-a-r---",
+			SegType:       "raid1",
+			Active:        true,
+			SyncPercent:   "100.00",
+			SyncAction:    "idle",
+			MismatchCount: 3,
+			Time:          time.Unix(1700000060, 0),
+			Major:         -1,
+			Minor:         -1,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLVs() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFindLV(t *testing.T) {
+	lvs := []LV{{Name: "pvc-10"}, {Name: "pvc-1"}, {Name: "pvc-100"}}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "pvc-1", want: "pvc-1"},
+		{name: "pvc-10", want: "pvc-10"},
+		{name: "pvc", want: ""},
+		{name: "pvc-1000", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findLV(lvs, tt.name)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("findLV() = %s, want none", got.Name)
+				}
+				return
+			}
+			if got == nil || got.Name != tt.want {
+				t.Errorf("findLV() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+// Package provisionerpod runs commands of the csi-lvm-provisioner on a node in short-lived privileged pods,
+// the controller creates and deletes volumes with them and csi-lvmctl inspects and repairs nodes.
+package provisionerpod
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// Command is the provisioner binary in the provisioner image
+const Command = "/csi-lvm-provisioner"
+
+// TerminationMessagePath is the file the provisioner writes the reason of a failure to,
+// the default /dev/termination-log is hidden by the /dev of the node
+const TerminationMessagePath = "/termination-log"
+
+// labels of the provisioner pods to find the pods of a controller which crashed in the middle of an operation
+const (
+	// LabelOperation identifies the operation which created the pod, only set by the controller
+	LabelOperation = "csi-lvm.metal-stack.io/operation"
+	// LabelAction is the action of the pod, e.g. create or delete
+	LabelAction = "csi-lvm.metal-stack.io/action"
+	// LabelVolume is the name of the persistent volume the pod operates on
+	LabelVolume = "csi-lvm.metal-stack.io/volume"
+	// LabelArgsHash is the hash of the node, image and command of the pod
+	LabelArgsHash = "csi-lvm.metal-stack.io/args-hash"
+)
+
+// Reason classifies why a provisioner pod failed, it decides whether the operation is retried and where
+type Reason string
+
+const (
+	// ReasonInsufficientSpace the node has not enough free space or usable physical volumes for the volume, another node may have
+	ReasonInsufficientSpace Reason = "InsufficientSpace"
+	// ReasonTransient the operation may succeed on the same node if it is retried, e.g. lvm was locked or the pod timed out
+	ReasonTransient Reason = "Transient"
+	// ReasonInvalid the parameters are invalid, the operation fails again if it is retried
+	ReasonInvalid Reason = "Invalid"
+	// ReasonConflict a volume of the same name but of another claim or shape exists
+	ReasonConflict Reason = "Conflict"
+	// ReasonBusy the volume is still in use and can not be deleted yet
+	ReasonBusy Reason = "Busy"
+	// ReasonUnknown the provisioner failed without a reason
+	ReasonUnknown Reason = "Unknown"
+)
+
+// Error is returned if a provisioner pod failed or timed out
+type Error struct {
+	Pod    string
+	Reason Reason
+	// Message is the error of the provisioner if it reported one
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("provisioner pod %s failed: %s", e.Pod, e.Reason)
+	}
+	return fmt.Sprintf("provisioner pod %s failed: %s %s", e.Pod, e.Reason, e.Message)
+}
+
+// Terminate writes the reason and the error to the termination message of the provisioner pod.
+// Nothing is written if the command does not run in a provisioner pod.
+func Terminate(reason Reason, err error) error {
+	// the file is created by the kubelet
+	f, e := os.OpenFile(TerminationMessagePath, os.O_WRONLY|os.O_TRUNC, 0)
+	if e != nil {
+		return nil
+	}
+	defer f.Close()
+	_, e = fmt.Fprintf(f, "%s: %v", reason, err)
+	return e
+}
+
+// terminationError reads the reason written by Terminate from the status of the failed pod
+func terminationError(pod *v1.Pod) *Error {
+	result := &Error{Pod: pod.Name, Reason: ReasonUnknown}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated == nil || status.State.Terminated.Message == "" {
+			continue
+		}
+		reason, message, found := strings.Cut(status.State.Terminated.Message, ": ")
+		switch Reason(reason) {
+		case ReasonInsufficientSpace, ReasonTransient, ReasonInvalid, ReasonConflict, ReasonBusy:
+			result.Reason = Reason(reason)
+		}
+		if !found {
+			message = reason
+		}
+		result.Message = message
+	}
+	return result
+}
+
+// Spec describes a provisioner pod
+type Spec struct {
+	Name      string
+	Namespace string
+	// Container is the name of the only container
+	Container      string
+	NodeName       string
+	Image          string
+	PullPolicy     v1.PullPolicy
+	ServiceAccount string
+	// Dir is the directory on the node the logical volumes are mounted
+	Dir string
+	// Command defaults to the provisioner binary
+	Command []string
+	Args    []string
+	// HostPID runs the pod in the pid namespace of the node to see the mounts of all processes
+	HostPID bool
+	// Operation, Action and Volume are set as labels of the pod if not empty
+	Operation string
+	Action    string
+	Volume    string
+}
+
+// ArgsHash returns the hash of everything the pod runs, a pod of the same name with another hash runs another operation
+func (s Spec) ArgsHash() string {
+	h := sha256.New()
+	fields := append([]string{s.NodeName, s.Image, s.Dir, fmt.Sprintf("%t", s.HostPID)}, s.Command...)
+	fields = append(fields, s.Args...)
+	for _, f := range fields {
+		// the length separates the fields
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+	// a label value has at most 63 characters
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+func (s Spec) labels() map[string]string {
+	labels := map[string]string{LabelArgsHash: s.ArgsHash()}
+	for key, value := range map[string]string{LabelOperation: s.Operation, LabelAction: s.Action, LabelVolume: s.Volume} {
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// Pod returns the privileged pod with access to the devices, lvm and the mount directory of the node
+func (s Spec) Pod() *v1.Pod {
+	command := s.Command
+	if len(command) == 0 {
+		command = []string{Command}
+	}
+	hostPathType := v1.HostPathDirectoryOrCreate
+	mountPropagation := v1.MountPropagationBidirectional
+	privileged := true
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.Name,
+			Namespace: s.Namespace,
+			Labels:    s.labels(),
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy:      v1.RestartPolicyNever,
+			NodeName:           s.NodeName,
+			ServiceAccountName: s.ServiceAccount,
+			HostPID:            s.HostPID,
+			Tolerations: []v1.Toleration{
+				{
+					Operator: v1.TolerationOpExists,
+				},
+			},
+			Containers: []v1.Container{
+				{
+					Name:                   s.Container,
+					Image:                  s.Image,
+					Command:                command,
+					Args:                   s.Args,
+					TerminationMessagePath: TerminationMessagePath,
+					Env: []v1.EnvVar{
+						{
+							Name: "NODE_NAME",
+							ValueFrom: &v1.EnvVarSource{
+								FieldRef: &v1.ObjectFieldSelector{
+									FieldPath: "spec.nodeName",
+								},
+							},
+						},
+					},
+					VolumeMounts: []v1.VolumeMount{
+						{
+							Name:             "data",
+							ReadOnly:         false,
+							MountPath:        s.Dir,
+							MountPropagation: &mountPropagation,
+						},
+						{
+							Name:      "devices",
+							ReadOnly:  false,
+							MountPath: "/dev",
+						},
+						{
+							Name:      "modules",
+							ReadOnly:  false,
+							MountPath: "/lib/modules",
+						},
+						{
+							Name:             "lvmbackup",
+							ReadOnly:         false,
+							MountPath:        "/etc/lvm/backup",
+							MountPropagation: &mountPropagation,
+						},
+						{
+							Name:             "lvmcache",
+							ReadOnly:         false,
+							MountPath:        "/etc/lvm/cache",
+							MountPropagation: &mountPropagation,
+						},
+						{
+							Name:             "lvmlock",
+							ReadOnly:         false,
+							MountPath:        "/run/lock/lvm",
+							MountPropagation: &mountPropagation,
+						},
+					},
+					ImagePullPolicy: s.PullPolicy,
+					SecurityContext: &v1.SecurityContext{
+						Privileged: &privileged,
+					},
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{
+							"cpu":    resource.MustParse("50m"),
+							"memory": resource.MustParse("50Mi"),
+						},
+						Limits: v1.ResourceList{
+							"cpu":    resource.MustParse("100m"),
+							"memory": resource.MustParse("100Mi"),
+						},
+					},
+				},
+			},
+			Volumes: []v1.Volume{
+				hostPathVolume("data", s.Dir, hostPathType),
+				hostPathVolume("devices", "/dev", hostPathType),
+				hostPathVolume("modules", "/lib/modules", hostPathType),
+				hostPathVolume("lvmbackup", "/etc/lvm/backup", hostPathType),
+				hostPathVolume("lvmcache", "/etc/lvm/cache", hostPathType),
+				hostPathVolume("lvmlock", "/run/lock/lvm", hostPathType),
+			},
+		},
+	}
+}
+
+func hostPathVolume(name, path string, hostPathType v1.HostPathType) v1.Volume {
+	return v1.Volume{
+		Name: name,
+		VolumeSource: v1.VolumeSource{
+			HostPath: &v1.HostPathVolumeSource{
+				Path: path,
+				Type: &hostPathType,
+			},
+		},
+	}
+}
+
+// Run creates the pod, waits until it succeeded and deletes it
+func Run(ctx context.Context, client clientset.Interface, s Spec, timeout time.Duration) error {
+	return run(ctx, client, s, timeout, nil)
+}
+
+// Output is like Run and returns the log of the pod, it is returned if the pod failed as well
+func Output(ctx context.Context, client clientset.Interface, s Spec, timeout time.Duration) (string, error) {
+	var output string
+	err := run(ctx, client, s, timeout, func(pod *v1.Pod) {
+		out, err := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &v1.PodLogOptions{Container: s.Container}).DoRaw(ctx)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "unable to read the log of the provisioner pod", "pod", pod.Name)
+			return
+		}
+		output = string(out)
+	})
+	return output, err
+}
+
+// run calls terminated with the terminated pod before it is deleted, it logs to the logger of the context
+func run(ctx context.Context, client clientset.Interface, s Spec, timeout time.Duration, terminated func(pod *v1.Pod)) error {
+	logger := klog.FromContext(ctx)
+	pods := client.CoreV1().Pods(s.Namespace)
+	pod := s.Pod()
+	_, err := pods.Create(ctx, pod, metav1.CreateOptions{})
+	if k8serror.IsAlreadyExists(err) {
+		err = adopt(ctx, pods, pod, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// the pod is deleted even if the operation was canceled
+		e := pods.Delete(context.WithoutCancel(ctx), s.Name, metav1.DeleteOptions{})
+		if e != nil {
+			logger.Error(e, "unable to delete the provisioner pod", "pod", s.Name)
+		}
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		pod, err := pods.Get(ctx, s.Name, metav1.GetOptions{})
+		if err != nil {
+			logger.Error(err, "error reading provisioner pod", "pod", s.Name)
+		} else {
+			switch pod.Status.Phase {
+			case v1.PodSucceeded:
+				logger.Info("provisioner pod terminated successfully", "pod", s.Name)
+				if terminated != nil {
+					terminated(pod)
+				}
+				return nil
+			case v1.PodFailed:
+				if terminated != nil {
+					terminated(pod)
+				}
+				return terminationError(pod)
+			}
+			logger.Info("provisioner pod status", "pod", s.Name, "phase", pod.Status.Phase)
+		}
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return &Error{Pod: s.Name, Reason: ReasonTransient, Message: fmt.Sprintf("timeout after %v", timeout)}
+}
+
+// adopt waits for an existing pod of the same name if it runs the same command, e.g. a pod created before the controller restarted.
+// A stale pod with another command is deleted and the pod is created again.
+func adopt(ctx context.Context, pods typedv1.PodInterface, pod *v1.Pod, timeout time.Duration) error {
+	logger := klog.FromContext(ctx)
+	existing, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if existing.DeletionTimestamp == nil && existing.Labels[LabelArgsHash] == pod.Labels[LabelArgsHash] {
+		logger.Info("adopting provisioner pod", "pod", pod.Name, "operation", existing.Labels[LabelOperation])
+		return nil
+	}
+
+	logger.Info("deleting stale provisioner pod", "pod", pod.Name, "operation", existing.Labels[LabelOperation])
+	err = pods.Delete(ctx, pod.Name, metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(existing.UID))})
+	if err != nil && !k8serror.IsNotFound(err) && !k8serror.IsConflict(err) {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err = pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		if k8serror.IsNotFound(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return &Error{Pod: pod.Name, Reason: ReasonTransient, Message: fmt.Sprintf("stale pod not deleted after %v", timeout)}
+		}
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	_, err = pods.Create(ctx, pod, metav1.CreateOptions{})
+	return err
+}
@@ -0,0 +1,62 @@
+// Package status contains the report of the status subcommand of the provisioner,
+// printed as json for csi-lvmctl and scripts which run it with kubectl exec.
+package status
+
+import "time"
+
+// Report is the state of the volumegroup of csi-lvm on a node
+type Report struct {
+	Node string    `json:"node,omitempty"`
+	Time time.Time `json:"time"`
+	// VG is nil if the volumegroup does not exist
+	VG  *VG  `json:"vg"`
+	PVs []PV `json:"pvs"`
+	// LVs are the logical volumes created by csi-lvm
+	LVs []LV `json:"lvs"`
+	// Errors are parts of the report which could not be determined
+	Errors []string `json:"errors,omitempty"`
+}
+
+// VG is a volumegroup, sizes are in bytes
+type VG struct {
+	Name    string `json:"name"`
+	Size    uint64 `json:"size"`
+	Free    uint64 `json:"free"`
+	PVCount int    `json:"pvCount"`
+	LVCount int    `json:"lvCount"`
+}
+
+// PV is a physical volume of the volumegroup
+type PV struct {
+	Device  string `json:"device"`
+	Size    uint64 `json:"size"`
+	Free    uint64 `json:"free"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+// LV is a logical volume created by csi-lvm
+type LV struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+	// Type is the lvm segment type, e.g. linear, striped or raid1
+	Type   string   `json:"type"`
+	Block  bool     `json:"block"`
+	Active bool     `json:"active"`
+	Tags   []string `json:"tags"`
+	// Claim is namespace/name of the claim from the tags, empty if unknown
+	Claim      string `json:"claim,omitempty"`
+	Mountpoint string `json:"mountpoint"`
+	Mounted    bool   `json:"mounted"`
+	// Usage is nil for block volumes and unmounted filesystems
+	Usage *Usage `json:"usage,omitempty"`
+	// Health is the reason a raid volume is degraded, empty if it is healthy or no raid
+	Health      string `json:"health,omitempty"`
+	SyncPercent string `json:"syncPercent,omitempty"`
+}
+
+// Usage of the filesystem of a volume in bytes
+type Usage struct {
+	Size      uint64 `json:"size"`
+	Used      uint64 `json:"used"`
+	Available uint64 `json:"available"`
+}
@@ -0,0 +1,281 @@
+// Package volume contains what the controller and the provisioner need to agree on:
+// the lv tags which describe a volume and the persistent volume built from them.
+package volume
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// Tag marks logical volumes created by csi-lvm
+	Tag = "lv.metal-stack.io/csi-lvm"
+
+	// KeyNode is the label of the node affinity of every persistent volume
+	KeyNode = "kubernetes.io/hostname"
+	// ProvisionerIdentityAnnotation holds the node a persistent volume was provisioned on
+	ProvisionerIdentityAnnotation = "lvmProvisionerIdentity"
+	// ProvisionedByAnnotation is set by the provisioner library, the controller only deletes volumes it provisioned
+	ProvisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+
+	tagPVCNamespace  = "pvc.namespace="
+	tagPVCName       = "pvc.name="
+	tagPVCUID        = "pvc.uid="
+	tagStorageClass  = "storageclass="
+	tagAccessModes   = "accessmodes="
+	tagVolumeMode    = "volumemode="
+	tagReclaimPolicy = "reclaimpolicy="
+	tagFSType        = "fstype="
+	tagCapacity      = "capacity="
+
+	// schemaTagPrefix holds the version of the tags of a logical volume, volumes without are version 0
+	schemaTagPrefix = "csi-lvm.schema="
+	// SchemaVersion is the version of the tags of logical volumes created now, the reviver migrates older ones
+	SchemaVersion = 3
+
+	// accessModeSeparator joins access modes, a comma separates tags in the output of lvs
+	accessModeSeparator = "+"
+)
+
+// Metadata is stored as lv tags, it contains everything to rebuild the persistent volume of a logical volume
+type Metadata struct {
+	PVCNamespace  string
+	PVCName       string
+	PVCUID        types.UID
+	StorageClass  string
+	AccessModes   []v1.PersistentVolumeAccessMode
+	VolumeMode    v1.PersistentVolumeMode
+	ReclaimPolicy v1.PersistentVolumeReclaimPolicy
+	// FSType is empty for block volumes
+	FSType   string
+	Capacity resource.Quantity
+}
+
+// Tags returns the lv tags of the metadata, the values are escaped to fit the lvm tag character set
+func (m Metadata) Tags() []string {
+	var modes []string
+	for _, mode := range m.AccessModes {
+		modes = append(modes, string(mode))
+	}
+	tags := []string{
+		tagPVCNamespace + escape(m.PVCNamespace),
+		tagPVCName + escape(m.PVCName),
+		tagStorageClass + escape(m.StorageClass),
+		tagAccessModes + escape(strings.Join(modes, accessModeSeparator)),
+		tagVolumeMode + escape(string(m.VolumeMode)),
+		tagReclaimPolicy + escape(string(m.ReclaimPolicy)),
+		tagCapacity + escape(m.Capacity.String()),
+	}
+	if m.PVCUID != "" {
+		tags = append(tags, tagPVCUID+escape(string(m.PVCUID)))
+	}
+	if m.FSType != "" {
+		tags = append(tags, FSTypeTag(m.FSType))
+	}
+	return tags
+}
+
+// ParseTags reads the metadata from lv tags, it fails if the persistent volume can not be rebuilt from them
+func ParseTags(tags []string) (Metadata, error) {
+	var (
+		m        Metadata
+		capacity string
+	)
+	for _, tag := range tags {
+		switch {
+		case strings.HasPrefix(tag, tagPVCNamespace):
+			m.PVCNamespace = unescape(strings.TrimPrefix(tag, tagPVCNamespace))
+		case strings.HasPrefix(tag, tagPVCName):
+			m.PVCName = unescape(strings.TrimPrefix(tag, tagPVCName))
+		case strings.HasPrefix(tag, tagPVCUID):
+			m.PVCUID = types.UID(unescape(strings.TrimPrefix(tag, tagPVCUID)))
+		case strings.HasPrefix(tag, tagStorageClass):
+			m.StorageClass = unescape(strings.TrimPrefix(tag, tagStorageClass))
+		case strings.HasPrefix(tag, tagAccessModes):
+			for _, mode := range strings.Split(unescape(strings.TrimPrefix(tag, tagAccessModes)), accessModeSeparator) {
+				if mode != "" {
+					m.AccessModes = append(m.AccessModes, v1.PersistentVolumeAccessMode(mode))
+				}
+			}
+		case strings.HasPrefix(tag, tagVolumeMode):
+			m.VolumeMode = v1.PersistentVolumeMode(unescape(strings.TrimPrefix(tag, tagVolumeMode)))
+		case strings.HasPrefix(tag, tagReclaimPolicy):
+			m.ReclaimPolicy = v1.PersistentVolumeReclaimPolicy(unescape(strings.TrimPrefix(tag, tagReclaimPolicy)))
+		case strings.HasPrefix(tag, tagFSType):
+			m.FSType = unescape(strings.TrimPrefix(tag, tagFSType))
+		case strings.HasPrefix(tag, tagCapacity):
+			capacity = unescape(strings.TrimPrefix(tag, tagCapacity))
+		}
+	}
+	if m.PVCNamespace == "" || m.PVCName == "" {
+		return m, fmt.Errorf("no persistent volume claim in tags")
+	}
+	if len(m.AccessModes) == 0 || m.VolumeMode == "" || m.ReclaimPolicy == "" || capacity == "" {
+		return m, fmt.Errorf("incomplete persistent volume metadata in tags")
+	}
+	q, err := resource.ParseQuantity(capacity)
+	if err != nil {
+		return m, fmt.Errorf("invalid capacity %s in tags: %w", capacity, err)
+	}
+	m.Capacity = q
+	return m, nil
+}
+
+// SchemaTag returns the tag of the given schema version
+func SchemaTag(version int) string {
+	return schemaTagPrefix + strconv.Itoa(version)
+}
+
+// FSTypeTag returns the tag of the filesystem type
+func FSTypeTag(fsType string) string {
+	return tagFSType + escape(fsType)
+}
+
+// Schema returns the schema version of the tags of a logical volume
+func Schema(tags []string) int {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, schemaTagPrefix) {
+			version, err := strconv.Atoi(strings.TrimPrefix(tag, schemaTagPrefix))
+			if err == nil {
+				return version
+			}
+		}
+	}
+	return 0
+}
+
+// Owner returns the namespace and name of the claim of a logical volume, empty if unknown
+func Owner(tags []string) string {
+	var namespace, name string
+	for _, tag := range tags {
+		switch {
+		case strings.HasPrefix(tag, tagPVCNamespace):
+			namespace = unescape(strings.TrimPrefix(tag, tagPVCNamespace))
+		case strings.HasPrefix(tag, tagPVCName):
+			name = unescape(strings.TrimPrefix(tag, tagPVCName))
+		}
+	}
+	if namespace == "" || name == "" {
+		return ""
+	}
+	return namespace + "/" + name
+}
+
+// ClaimUID returns the uid of the claim of a logical volume, empty if unknown
+func ClaimUID(tags []string) types.UID {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, tagPVCUID) {
+			return types.UID(unescape(strings.TrimPrefix(tag, tagPVCUID)))
+		}
+	}
+	return ""
+}
+
+// escapeChar starts the hex encoding of a byte which is not allowed in lvm tags
+const escapeChar = '&'
+
+// tagChar returns true if lvm allows the byte in tags
+func tagChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("_+.-/=!:#", c) >= 0
+}
+
+// escape encodes all bytes of a value which are not allowed in lvm tags as &xx
+func escape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if tagChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%c%02x", escapeChar, c)
+	}
+	return b.String()
+}
+
+// unescape reverts escape, invalid escape sequences are kept as they are
+func unescape(value string) string {
+	if strings.IndexByte(value, escapeChar) < 0 {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == escapeChar && i+2 < len(value) {
+			if c, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// PersistentVolume returns the local persistent volume of a logical volume on the given node
+func PersistentVolume(name, path, nodeName string, m Metadata) *v1.PersistentVolume {
+	volumeMode := m.VolumeMode
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				ProvisionerIdentityAnnotation: nodeName,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: m.ReclaimPolicy,
+			AccessModes:                   m.AccessModes,
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: m.Capacity,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				Local: &v1.LocalVolumeSource{
+					Path: path,
+				},
+			},
+			VolumeMode: &volumeMode,
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{
+									Key:      KeyNode,
+									Operator: v1.NodeSelectorOpIn,
+									Values: []string{
+										nodeName,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// Node returns the node of the node affinity of a persistent volume, empty if it has none
+func Node(pv *v1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expression := range term.MatchExpressions {
+			if expression.Key == KeyNode && expression.Operator == v1.NodeSelectorOpIn && len(expression.Values) == 1 {
+				return expression.Values[0]
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package volume
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "allowed characters", value: "my-claim.v1_a+b/c=d!e:f#g", want: "my-claim.v1_a+b/c=d!e:f#g"},
+		{name: "space", value: "a b", want: "a&20b"},
+		{name: "comma separates tags", value: "a,b", want: "a&2cb"},
+		{name: "escape character itself", value: "a&b", want: "a&26b"},
+		{name: "non ascii", value: "ä", want: "&c3&a4"},
+		{name: "empty", value: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := escape(tt.value)
+			if got != tt.want {
+				t.Errorf("escape() = %q, want %q", got, tt.want)
+			}
+			if back := unescape(got); back != tt.value {
+				t.Errorf("unescape(escape()) = %q, want %q", back, tt.value)
+			}
+		})
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "nothing escaped", value: "pvc-1", want: "pvc-1"},
+		{name: "escaped", value: "a&20b&2cc", want: "a b,c"},
+		{name: "invalid hex is kept", value: "a&zzb", want: "a&zzb"},
+		{name: "truncated sequence is kept", value: "a&2", want: "a&2"},
+		{name: "trailing escape character is kept", value: "a&", want: "a&"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unescape(tt.value); got != tt.want {
+				t.Errorf("unescape() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	metadata := Metadata{
+		PVCNamespace:  "default",
+		PVCName:       "data, with comma",
+		PVCUID:        "8a4f9c2e-1b3d-4e5f-9a8b-7c6d5e4f3a2b",
+		StorageClass:  "csi-lvm-sc-mirror",
+		AccessModes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadWriteOncePod},
+		VolumeMode:    v1.PersistentVolumeFilesystem,
+		ReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		FSType:        "ext4",
+		Capacity:      resource.MustParse("10Gi"),
+	}
+	tests := []struct {
+		name    string
+		tags    []string
+		want    Metadata
+		wantErr bool
+	}{
+		{
+			name: "round trip with other tags",
+			tags: append([]string{Tag, "isBlock=false", SchemaTag(SchemaVersion)}, metadata.Tags()...),
+			want: metadata,
+		},
+		{
+			name: "block volume without fstype and uid",
+			tags: Metadata{
+				PVCNamespace:  "default",
+				PVCName:       "raw",
+				StorageClass:  "csi-lvm-sc-linear",
+				AccessModes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				VolumeMode:    v1.PersistentVolumeBlock,
+				ReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+				Capacity:      resource.MustParse("1Gi"),
+			}.Tags(),
+			want: Metadata{
+				PVCNamespace:  "default",
+				PVCName:       "raw",
+				StorageClass:  "csi-lvm-sc-linear",
+				AccessModes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				VolumeMode:    v1.PersistentVolumeBlock,
+				ReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+				Capacity:      resource.MustParse("1Gi"),
+			},
+		},
+		{
+			name:    "no claim",
+			tags:    []string{Tag, "isBlock=false"},
+			wantErr: true,
+		},
+		{
+			name:    "incomplete",
+			tags:    []string{tagPVCNamespace + "default", tagPVCName + "data", tagCapacity + "1Gi"},
+			wantErr: true,
+		},
+		{
+			name: "invalid capacity",
+			tags: []string{
+				tagPVCNamespace + "default",
+				tagPVCName + "data",
+				tagAccessModes + "ReadWriteOnce",
+				tagVolumeMode + "Filesystem",
+				tagReclaimPolicy + "Delete",
+				tagCapacity + "ten",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTags(tt.tags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Capacity.Cmp(tt.want.Capacity) != 0 {
+				t.Errorf("ParseTags() capacity = %s, want %s", got.Capacity.String(), tt.want.Capacity.String())
+			}
+			got.Capacity, tt.want.Capacity = resource.Quantity{}, resource.Quantity{}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTags() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchema(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		want int
+	}{
+		{name: "no schema tag", tags: []string{Tag}, want: 0},
+		{name: "schema tag", tags: []string{Tag, SchemaTag(2)}, want: 2},
+		{name: "invalid schema tag", tags: []string{schemaTagPrefix + "x"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Schema(tt.tags); got != tt.want {
+				t.Errorf("Schema() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}